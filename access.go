@@ -0,0 +1,289 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"pubgo/config"
+	"pubgo/content"
+)
+
+const (
+	accessPublic        = "public"
+	accessAuthenticated = "authenticated"
+	accessPassword      = "password"
+)
+
+// accessRule is who may see a page or entry. Password is the bcrypt hash
+// of the password it is shared with, Scope names what it protects so one
+// password unlocks a collection along with its entries.
+type accessRule struct {
+	Level    string
+	Password string
+	Scope    string
+}
+
+// Public reports whether anyone may see what the rule protects.
+func (a accessRule) Public() bool {
+	return a.Level == "" || a.Level == accessPublic
+}
+
+// pageAccess returns the access rule of a page.
+func pageAccess(page config.Page) accessRule {
+	return accessRule{Level: page.Access, Password: page.Password, Scope: page.Name}
+}
+
+// entryAccess returns the access rule of an entry of page, its own if its
+// front matter sets one and the page's otherwise.
+func entryAccess(page config.Page, entry content.Entry, scope string) accessRule {
+	if entry.Access == "" {
+		return pageAccess(page)
+	}
+	return accessRule{Level: entry.Access, Password: entry.Password, Scope: scope}
+}
+
+// listed reports whether an entry shows up in the listings of its page.
+// Entries more restricted than their page are only reachable by their URL.
+func listed(page config.Page, entry content.Entry) bool {
+	rule := entryAccess(page, entry, "")
+	return rule.Public() || rule.Level == page.Access && rule.Password == page.Password
+}
+
+// publishedAccess returns the access rule of a page as published, which
+// for non-collection pages may be set in the front matter of their file.
+func publishedAccess(page config.Page) accessRule {
+	if page.Collection {
+		return pageAccess(page)
+	}
+	file, _ := localizedFile(page.Lang, page.Name+".md")
+	return singlePageAccess(page, file)
+}
+
+// publicEntries returns the entries of a collection anyone may see.
+func publicEntries(page config.Page) content.Entries {
+	if !pageAccess(page).Public() {
+		return nil
+	}
+	return collectionEntries(page)
+}
+
+// singlePageAccess returns the access rule of a non-collection page, taking
+// the front matter of its file into account.
+func singlePageAccess(page config.Page, file string) accessRule {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return pageAccess(page)
+	}
+	entry, _, _ := content.ParseEntry(data)
+	return entryAccess(page, entry, page.Name)
+}
+
+// routeAccess returns the access rule of the page or entry at path, whose
+// content is in file.
+func routeAccess(path, lang, file string) accessRule {
+	if isDir(file) {
+		for _, p := range cfg.Site.Pages {
+			if p.Path == path || p.Path+"/" == path {
+				return pageAccess(p)
+			}
+		}
+		return accessRule{}
+	}
+
+	// match pages by their file, which is found under more than one path
+	if isSinglePage(path) {
+		for _, p := range cfg.Site.Pages {
+			if f, ok := localizedFile(lang, p.Name+".md"); ok && !p.Collection && f == file {
+				return singlePageAccess(p, file)
+			}
+		}
+		return singlePageAccess(config.Page{Name: strings.TrimPrefix(path, "/")}, file)
+	}
+
+	rel := strings.TrimPrefix(path, "/")
+	name, _, _ := strings.Cut(rel, "/")
+	page, _ := pageByName(name)
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return pageAccess(page)
+	}
+	entry, _, _ := content.ParseEntry(data)
+	return entryAccess(page, entry, strings.TrimSuffix(rel, filepath.Ext(rel)))
+}
+
+// checkAccess reports pages with an unknown access level or a password
+// that isn't a bcrypt hash.
+func checkAccess() {
+	for _, page := range cfg.Site.Pages {
+		checkAccessRule("page "+page.Name, pageAccess(page))
+	}
+}
+
+func checkAccessRule(what string, rule accessRule) bool {
+	switch rule.Level {
+	case "", accessPublic, accessAuthenticated:
+		return true
+	case accessPassword:
+		if _, err := bcrypt.Cost([]byte(rule.Password)); err != nil {
+			report.Error("The password of", what, "isn't a bcrypt hash, make one with: pubgo hash")
+			return false
+		}
+		return true
+	}
+	report.Error("Unknown access", rule.Level, "of", what)
+	return false
+}
+
+// skipRestricted reports whether what the rule protects is left out of a
+// static build, which has no way to enforce it.
+func skipRestricted(what string, rule accessRule) bool {
+	if rule.Public() {
+		return false
+	}
+	report.Warn("Skipping", what+", its access is", rule.Level, "which only the server can enforce")
+	return true
+}
+
+// accessSecret signs the cookies of visitors who entered a page password.
+// It is made at start up, so they enter it again after a restart.
+var accessSecret = randomBytes(32)
+
+var accessLimiter *rateLimiter
+
+// accessPage is the data of the accessHTML template.
+type accessPage struct {
+	content.Content
+	CSRF  string
+	Error string
+}
+
+func accessCookieName(scope string) string {
+	sum := sha256.Sum256([]byte(scope))
+	return "pubgo_access_" + hex.EncodeToString(sum[:6])
+}
+
+// accessToken is the cookie value granting access to the scope of rule.
+// It changes along with the password.
+func accessToken(rule accessRule) string {
+	mac := hmac.New(sha256.New, accessSecret)
+	mac.Write([]byte(rule.Scope + "\x00" + rule.Password))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// accessGranted reports whether the visitor may see what rule protects:
+// anyone may see public pages, signed in users every page and visitors who
+// unlocked a page with its password that page.
+func accessGranted(r *http.Request, rule accessRule) bool {
+	if rule.Public() {
+		return true
+	}
+	if rule.Level != accessAuthenticated && rule.Level != accessPassword {
+		return false
+	}
+	if _, _, ok := currentUser(r); ok {
+		return true
+	}
+	if rule.Level == accessPassword {
+		c, err := r.Cookie(accessCookieName(rule.Scope))
+		return err == nil && hmac.Equal([]byte(c.Value), []byte(accessToken(rule)))
+	}
+	return false
+}
+
+// allowAccess reports whether the visitor may see what rule protects.
+// Otherwise it sends them to sign in, or asks for the page's password and
+// checks it when posted back.
+func allowAccess(w http.ResponseWriter, r *http.Request, rule accessRule) bool {
+	if accessGranted(r, rule) {
+		return true
+	}
+
+	switch rule.Level {
+	case accessAuthenticated:
+		login := "/admin/login?next=" + url.QueryEscape(r.URL.Path)
+		if r.Header.Get("HX-Request") == "true" {
+			w.Header().Set("HX-Redirect", login)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		} else {
+			http.Redirect(w, r, login, http.StatusSeeOther)
+		}
+		return false
+
+	case accessPassword:
+		if r.Method == http.MethodPost {
+			unlock(w, r, rule)
+			return false
+		}
+		// htmx doesn't swap in the form of an unsuccessful response, load
+		// the whole page instead
+		if r.Header.Get("HX-Request") == "true" {
+			w.Header().Set("HX-Redirect", r.URL.Path)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return false
+		}
+		renderAccessPage(w, r, http.StatusUnauthorized, "")
+		return false
+	}
+
+	log.Println("Unknown access", rule.Level, "of", r.URL.Path)
+	http.Error(w, "Forbidden", http.StatusForbidden)
+	return false
+}
+
+// unlock checks a password posted to a protected page and hands out the
+// cookie granting access to it.
+func unlock(w http.ResponseWriter, r *http.Request, rule accessRule) {
+	switch {
+	case !checkCSRF(r, "access"):
+		renderAccessPage(w, r, http.StatusForbidden, "The form expired, please try again.")
+	case !accessLimiter.Allow(clientIP(r)):
+		renderAccessPage(w, r, http.StatusTooManyRequests, "Too many attempts, please try again later.")
+	case bcrypt.CompareHashAndPassword([]byte(rule.Password), []byte(r.PostFormValue("password"))) != nil:
+		log.Println("Wrong password for", rule.Scope, "from", clientIP(r))
+		renderAccessPage(w, r, http.StatusUnauthorized, "Wrong password.")
+	default:
+		http.SetCookie(w, &http.Cookie{
+			Name:     accessCookieName(rule.Scope),
+			Value:    accessToken(rule),
+			Path:     "/",
+			Expires:  time.Now().Add(time.Duration(cfg.Admin.SessionHours) * time.Hour),
+			HttpOnly: true,
+			Secure:   r.TLS != nil,
+			SameSite: http.SameSiteLaxMode,
+		})
+		http.Redirect(w, r, r.URL.Path, http.StatusSeeOther)
+	}
+}
+
+// renderAccessPage asks for the password of a protected page, showing the
+// translation of message.
+func renderAccessPage(w http.ResponseWriter, r *http.Request, status int, message string) {
+	lang, _ := splitLanguage(r.URL.Path)
+	page := accessPage{
+		Content: content.Content{
+			Site:        cfg.Site,
+			Page:        config.Page{Lang: lang},
+			RequestPath: r.URL.Path,
+			BasePath:    cfg.BaseURL,
+			Mode:        cfg.Mode,
+			Title:       cfg.Site.Name + " ~ " + i18n("Protected page", lang),
+		},
+		CSRF: csrfToken(csrfID(w, r), "access"),
+	}
+	if message != "" {
+		page.Error = i18n(message, lang)
+	}
+	localizeContent(&page.Content)
+	executeTemplate(w, status, "accessHTML", page)
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"pubgo/config"
+	"pubgo/content"
+)
+
+// adminPage is the data of the adminHTML template.
+type adminPage struct {
+	content.Content
+	User     User
+	CSRF     string
+	Comments []Comment
+	Audit    []AuditEvent
+	Users    []User
+	Deploy   *deployPage
+	Error    string
+}
+
+// loginPage is the data of the loginHTML template.
+type loginPage struct {
+	content.Content
+	CSRF  string
+	Name  string
+	Next  string
+	Error string
+}
+
+var loginLimiter *rateLimiter
+
+// adminContent returns the page data shared by the admin's pages.
+func adminContent(r *http.Request, title string) content.Content {
+	cont := content.Content{
+		Site:        cfg.Site,
+		Page:        config.Page{Lang: defaultLanguage()},
+		RequestPath: r.URL.Path,
+		BasePath:    cfg.BaseURL,
+		Mode:        cfg.Mode,
+		Title:       cfg.Site.Name + " ~ " + title,
+	}
+	localizeContent(&cont)
+	return cont
+}
+
+// adminAuthorized returns the signed in user of a request to the admin if
+// their role has permission, or any signed in user for an empty one.
+// Visitors who aren't signed in are sent to the login page. Changes have
+// to carry the CSRF token of the user's session.
+func adminAuthorized(w http.ResponseWriter, r *http.Request, permission string) (User, session, bool) {
+	if users, _ := loadUsers(); len(users) == 0 {
+		http.Error(w, "Add a user with pubgo user <name> <role> to use the admin", http.StatusForbidden)
+		return User{}, session{}, false
+	}
+
+	user, sess, ok := currentUser(r)
+	if !ok {
+		if r.Header.Get("HX-Request") == "true" {
+			w.Header().Set("HX-Redirect", "/admin/login")
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		} else {
+			http.Redirect(w, r, "/admin/login", http.StatusSeeOther)
+		}
+		return User{}, session{}, false
+	}
+
+	if r.Method != http.MethodGet && !validCSRFToken(r.PostFormValue(csrfField), sess.ID, "admin") {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return User{}, session{}, false
+	}
+	if permission != "" && !user.Can(permission) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return User{}, session{}, false
+	}
+	return user, sess, true
+}
+
+// newAdminPage loads the data shown to user in the admin.
+func newAdminPage(r *http.Request, user User, sess session) adminPage {
+	page := adminPage{
+		Content: adminContent(r, "Admin"),
+		User:    user,
+		CSRF:    csrfToken(sess.ID, "admin"),
+	}
+
+	var err error
+	if user.Can("moderate") {
+		page.Comments, err = comments.All()
+		if err != nil {
+			log.Println("Error loading comments:", err)
+			page.Error = "Error loading comments: " + err.Error()
+		}
+	}
+	if user.Can("audit") {
+		page.Audit, err = recentAuditEvents(50)
+		if err != nil {
+			log.Println("Error loading audit log:", err)
+		}
+	}
+	if user.Can("users") {
+		page.Users, err = loadUsers()
+		if err != nil {
+			log.Println("Error loading users:", err)
+		}
+	}
+	if user.Can("deploy") && deployEnabled() {
+		page.Deploy = &deployPage{CSRF: page.CSRF, Status: deploys.Status()}
+	}
+	return page
+}
+
+// renderAdminPage renders the admin.
+func renderAdminPage(w http.ResponseWriter, r *http.Request, user User, sess session) {
+	executeTemplate(w, 0, "adminHTML", newAdminPage(r, user, sess))
+}
+
+// moderateComment approves or deletes a comment and returns the updated
+// moderation section.
+func moderateComment(w http.ResponseWriter, r *http.Request, user User, sess session) {
+	action := r.PostFormValue("action")
+	if action != "approve" && action != "delete" {
+		http.Error(w, "Unknown action", http.StatusBadRequest)
+		return
+	}
+
+	key, id := commentKey(r.PostFormValue("path")), r.PostFormValue("id")
+	err := comments.Moderate(key, id, action == "approve")
+
+	page := newAdminPage(r, user, sess)
+	if err != nil {
+		log.Println("Error moderating comment:", err)
+		page.Error = err.Error()
+	} else {
+		log.Println("Comment", id, "on", key, action+"d by", user.Name)
+		audit(r, user.Name, "comment "+action, key+"#"+id)
+	}
+	executeTemplate(w, 0, "commentModerationHTML", page)
+}
+
+// renderLoginPage renders the login form with status.
+func renderLoginPage(w http.ResponseWriter, r *http.Request, status int, name, message string) {
+	page := loginPage{
+		Content: adminContent(r, "Sign in"),
+		CSRF:    csrfToken(csrfID(w, r), "login"),
+		Name:    name,
+		Next:    r.FormValue("next"),
+		Error:   message,
+	}
+	executeTemplate(w, status, "loginHTML", page)
+}
+
+// login signs a user in with the name and password posted to the login
+// form. Failed attempts are rate limited per client and recorded in the
+// audit log.
+func login(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimSpace(r.PostFormValue("name"))
+
+	if !checkCSRF(r, "login") {
+		renderLoginPage(w, r, http.StatusForbidden, name, "Your login form expired, please try again.")
+		return
+	}
+	if !loginLimiter.Allow(clientIP(r)) {
+		renderLoginPage(w, r, http.StatusTooManyRequests, name, "Too many login attempts, please try again later.")
+		return
+	}
+
+	user, ok := authenticate(name, r.PostFormValue("password"))
+	if !ok {
+		log.Println("Failed login as", name, "from", clientIP(r))
+		audit(r, name, "login failed", "")
+		renderLoginPage(w, r, http.StatusUnauthorized, name, "Wrong name or password.")
+		return
+	}
+
+	sess := sessions.Create(user.Name)
+	setSessionCookie(w, r, sess)
+	log.Println(user.Name, "signed in from", clientIP(r))
+	audit(r, user.Name, "login", "")
+	http.Redirect(w, r, loginRedirect(r.PostFormValue("next")), http.StatusSeeOther)
+}
+
+// loginRedirect returns where to go after signing in, the protected page
+// that sent the user to log in or the admin. Only paths on this site are
+// followed.
+func loginRedirect(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return "/admin"
+	}
+	return next
+}
+
+// setupAdminRoutes registers the admin handlers.
+func setupAdminRoutes() {
+	loginLimiter = newRateLimiter(cfg.Admin.LoginRateLimit, 15*time.Minute)
+
+	http.HandleFunc("/admin", func(w http.ResponseWriter, r *http.Request) {
+		logRequest(r)
+		user, sess, ok := adminAuthorized(w, r, "")
+		if !ok {
+			return
+		}
+		renderAdminPage(w, r, user, sess)
+	})
+
+	http.HandleFunc("/admin/login", func(w http.ResponseWriter, r *http.Request) {
+		logRequest(r)
+		switch r.Method {
+		case http.MethodGet:
+			if _, _, ok := currentUser(r); ok {
+				http.Redirect(w, r, loginRedirect(r.FormValue("next")), http.StatusSeeOther)
+				return
+			}
+			renderLoginPage(w, r, 0, "", "")
+		case http.MethodPost:
+			login(w, r)
+		default:
+			w.Header().Set("Allow", "GET, POST")
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+
+	http.HandleFunc("/admin/logout", func(w http.ResponseWriter, r *http.Request) {
+		logRequest(r)
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		user, sess, ok := adminAuthorized(w, r, "")
+		if !ok {
+			return
+		}
+		sessions.Delete(sess.ID)
+		setSessionCookie(w, r, session{})
+		audit(r, user.Name, "logout", "")
+		http.Redirect(w, r, "/admin/login", http.StatusSeeOther)
+	})
+
+	http.HandleFunc("/admin/comments", func(w http.ResponseWriter, r *http.Request) {
+		logRequest(r)
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		user, sess, ok := adminAuthorized(w, r, "moderate")
+		if !ok {
+			return
+		}
+		moderateComment(w, r, user, sess)
+	})
+}
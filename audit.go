@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// AuditEvent is a line of the audit log recording who did what in the
+// admin.
+type AuditEvent struct {
+	Date   time.Time `json:"date"`
+	User   string    `json:"user"`
+	IP     string    `json:"ip"`
+	Action string    `json:"action"`
+	Target string    `json:"target,omitempty"`
+}
+
+var auditMu sync.Mutex
+
+// audit appends an event to the audit log, one JSON object per line.
+func audit(r *http.Request, user, action, target string) {
+	event := AuditEvent{
+		Date:   time.Now(),
+		User:   user,
+		IP:     clientIP(r),
+		Action: action,
+		Target: target,
+	}
+	data, err := json.Marshal(event)
+	if err != nil {
+		log.Println("Error writing audit log:", err)
+		return
+	}
+
+	auditMu.Lock()
+	defer auditMu.Unlock()
+
+	f, err := os.OpenFile(cfg.Admin.AuditLog, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		log.Println("Error writing audit log:", err)
+		return
+	}
+	defer f.Close()
+
+	_, err = f.Write(append(data, '\n'))
+	if err != nil {
+		log.Println("Error writing audit log:", err)
+	}
+}
+
+// recentAuditEvents returns the last n events of the audit log, newest
+// first.
+func recentAuditEvents(n int) ([]AuditEvent, error) {
+	auditMu.Lock()
+	defer auditMu.Unlock()
+
+	f, err := os.Open(cfg.Admin.AuditLog)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var events []AuditEvent
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var event AuditEvent
+		if json.Unmarshal(scanner.Bytes(), &event) != nil {
+			continue
+		}
+		events = append(events, event)
+		if len(events) > n {
+			events = events[1:]
+		}
+	}
+
+	for i, j := 0, len(events)-1; i < j; i, j = i+1, j-1 {
+		events[i], events[j] = events[j], events[i]
+	}
+	return events, scanner.Err()
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+var (
+	tagPattern    = regexp.MustCompile(`<([a-zA-Z]+)\s[^>]*>`)
+	linkPattern   = regexp.MustCompile(`\s(href|src)="([^"]*)"`)
+	anchorPattern = regexp.MustCompile(`\s(?:id|name)="([^"]*)"`)
+)
+
+// checkedPage is a page rendered in memory by the site checker.
+type checkedPage struct {
+	status int
+	html   bool
+	body   string
+	ids    map[string]bool
+	// protected is set for pages asking visitors to sign in or for a
+	// password, which the checker doesn't get past.
+	protected bool
+}
+
+// siteChecker crawls the site through the same handlers used in serve mode,
+// as a visitor who isn't signed in, and records every problem it finds on
+// the build report.
+type siteChecker struct {
+	handler   http.Handler
+	pages     map[string]*checkedPage
+	linked    map[string]bool
+	protected map[string]bool
+	external  map[string]error
+	client    *http.Client
+}
+
+// checkSite renders the site in memory starting from the configured pages,
+// follows every internal link and reports broken links, missing images,
+// dangling anchors and entries nothing links to.
+func checkSite() {
+	serveStaticFiles()
+	serveCSSTemplate()
+	serveSyntaxCSS()
+	serveScripts()
+	setupRouter()
+
+	c := &siteChecker{
+		handler:   http.DefaultServeMux,
+		pages:     make(map[string]*checkedPage),
+		linked:    make(map[string]bool),
+		protected: make(map[string]bool),
+		external:  make(map[string]error),
+		client:    &http.Client{Timeout: 10 * time.Second},
+	}
+
+	var keys []string
+	for key := range cfg.Site.Pages {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var queue []string
+	for _, lang := range languageCodes() {
+		for _, key := range keys {
+			page := localizePage(cfg.Site.Pages[key], lang)
+			route, err := parseRoute(unlocalizedPath(page), lang)
+			if err != nil && lang != defaultLanguage() {
+				// pages missing a translation aren't published in lang
+				continue
+			}
+			if err == nil {
+				c.linked[route] = true
+			}
+			queue = append(queue, page.Path)
+		}
+	}
+
+	crawled := make(map[string]bool)
+	for len(queue) > 0 {
+		path := queue[0]
+		queue = queue[1:]
+		if crawled[path] {
+			continue
+		}
+		crawled[path] = true
+
+		page := c.fetch(path)
+		if page.protected {
+			// the files behind it aren't orphans, just out of reach
+			lang, rest := splitLanguage(path)
+			if route, err := parseRoute(rest, lang); err == nil {
+				c.protected[route] = true
+			}
+			continue
+		}
+		if page.status >= 400 {
+			report.Error(fmt.Sprintf("Page %s returned status %d", path, page.status))
+			continue
+		}
+		if !page.html {
+			continue
+		}
+
+		queue = append(queue, c.checkLinks(path, page)...)
+	}
+
+	c.checkOrphans()
+}
+
+// fetch renders path in memory, caching the result.
+func (c *siteChecker) fetch(path string) *checkedPage {
+	if page, ok := c.pages[path]; ok {
+		return page
+	}
+
+	rec := httptest.NewRecorder()
+	c.handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+
+	page := &checkedPage{
+		status:    rec.Code,
+		html:      strings.HasPrefix(rec.Header().Get("Content-Type"), "text/html"),
+		body:      rec.Body.String(),
+		ids:       make(map[string]bool),
+		protected: rec.Code == http.StatusUnauthorized || strings.HasPrefix(rec.Header().Get("Location"), "/admin/login"),
+	}
+	for _, m := range anchorPattern.FindAllStringSubmatch(page.body, -1) {
+		page.ids[html.UnescapeString(m[1])] = true
+	}
+
+	c.pages[path] = page
+	return page
+}
+
+// checkLinks checks every href and src on page and returns the internal
+// pages it links to.
+func (c *siteChecker) checkLinks(path string, page *checkedPage) []string {
+	base, _ := url.Parse(path)
+	var next []string
+
+	for _, tag := range tagPattern.FindAllStringSubmatch(page.body, -1) {
+		name := strings.ToLower(tag[1])
+		for _, attr := range linkPattern.FindAllStringSubmatch(tag[0], -1) {
+			link := html.UnescapeString(attr[2])
+			if cfg.BaseURL != "" && strings.HasPrefix(link, cfg.BaseURL) {
+				link = "/" + strings.TrimPrefix(strings.TrimPrefix(link, cfg.BaseURL), "/")
+			}
+
+			u, err := url.Parse(link)
+			if err != nil {
+				report.Error(fmt.Sprintf("Malformed link on %s: %q", path, link))
+				continue
+			}
+
+			switch u.Scheme {
+			case "mailto", "tel", "javascript", "data":
+				continue
+			case "http", "https":
+				c.checkExternal(path, u)
+				continue
+			}
+			if u.Host != "" {
+				c.checkExternal(path, u)
+				continue
+			}
+
+			target := base.ResolveReference(u)
+			targetPath := target.Path
+			if targetPath == "" {
+				targetPath = path
+			}
+
+			targetPage := c.fetch(targetPath)
+			if targetPage.status >= 400 && !targetPage.protected {
+				if name == "img" {
+					report.Error(fmt.Sprintf("Missing image on %s: %s", path, link))
+				} else {
+					report.Error(fmt.Sprintf("Broken link on %s: %s", path, link))
+				}
+				continue
+			}
+
+			targetLang, targetRest := splitLanguage(targetPath)
+			if route, err := parseRoute(targetRest, targetLang); err == nil {
+				c.linked[route] = true
+			}
+
+			if u.Fragment != "" && targetPage.html && !targetPage.protected && !targetPage.ids[u.Fragment] {
+				report.Error(fmt.Sprintf("Dangling anchor on %s: %s", path, link))
+			}
+
+			if targetPage.html {
+				next = append(next, targetPath)
+			}
+		}
+	}
+
+	return next
+}
+
+// checkExternal requests an external link when external checking is enabled
+// and the host is on the allow list.
+func (c *siteChecker) checkExternal(path string, u *url.URL) {
+	if !cfg.Check.External || !hostAllowed(u.Hostname()) {
+		return
+	}
+
+	link := u.String()
+	err, ok := c.external[link]
+	if !ok {
+		err = c.request(link)
+		c.external[link] = err
+	}
+	if err != nil {
+		report.Error(fmt.Sprintf("Broken external link on %s: %s (%s)", path, link, err))
+	}
+}
+
+// request performs a HEAD request for link, falling back to GET for servers
+// that don't support HEAD.
+func (c *siteChecker) request(link string) error {
+	resp, err := c.client.Head(link)
+	if err == nil {
+		resp.Body.Close()
+		if resp.StatusCode < 400 {
+			return nil
+		}
+	}
+
+	resp, err = c.client.Get(link)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// hostAllowed reports whether the checker may contact host. Only hosts on
+// the allow list are, none while it is empty.
+func hostAllowed(host string) bool {
+	for _, allowed := range cfg.Check.AllowedHosts {
+		if host == allowed || strings.HasSuffix(host, "."+allowed) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkOrphans warns about markdown files in the content directory that no
+// crawled page links to.
+func (c *siteChecker) checkOrphans() {
+	skip := map[string]bool{
+		filepath.Join(cfg.ContentDir, "static"):    true,
+		filepath.Join(cfg.ContentDir, "templates"): true,
+		filepath.Join(cfg.ContentDir, "themes"):    true,
+	}
+
+	filepath.Walk(cfg.ContentDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if info.IsDir() {
+			if skip[path] {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if filepath.Ext(path) == ".md" && !c.linked[path] && !c.behindProtected(path) {
+			report.Warn("Orphaned entry, nothing links to", path)
+		}
+		return nil
+	})
+}
+
+// behindProtected reports whether file is a protected page or inside a
+// protected collection, which the checker can't crawl.
+func (c *siteChecker) behindProtected(file string) bool {
+	for route := range c.protected {
+		if file == route || strings.HasPrefix(file, route+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
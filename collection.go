@@ -1,7 +1,9 @@
 package main
 
 import (
+	"fmt"
 	"html/template"
+	"io/fs"
 	"io/ioutil"
 	"log"
 	"os"
@@ -10,8 +12,6 @@ import (
 
 	"pubgo/config"
 	"pubgo/content"
-
-	"github.com/gomarkdown/markdown"
 )
 
 // buildCollectionPage builds a collection page.
@@ -25,14 +25,15 @@ func buildCollectionPage(page config.Page) {
 
 	wr, err := os.Create(cfg.OutputDir + page.Path + "/index.html")
 	if err != nil {
-		log.Println("Error creating file:", err)
+		report.Error("Error creating file:", err)
 		return
 	}
 
-	err = templates.ExecuteTemplate(wr, "indexHTML", cont)
+	err = templates.ExecuteTemplate(wr, layoutTemplate(page.Layout), cont)
 	if err != nil {
-		log.Println("Error executing template:", err)
+		report.Error("Error executing template for collection", page.Name+":", err)
 	}
+	wr.Close()
 
 	buildEntryPages(page)
 }
@@ -41,12 +42,19 @@ func buildCollectionPage(page config.Page) {
 func buildEntryPages(page config.Page) {
 	log.Printf("Building entry pages for collection: %s", page.Name)
 
-	ents := entries[page.Name]
+	ents := content.Entries(entries[page.Name])
 	log.Printf("Entries: %+v", ents)
 
 	for _, entry := range ents {
 
-		entryBody := loadEntryBody(page, entry) // Updated here
+		entryBody, err := loadEntryBody(page, entry)
+		if err != nil {
+			report.Error("Error loading entry", page.Name+"/"+entry.FileName+":", err)
+			// the rest of an entry with a broken shortcode is still built
+			if entryBody == "" {
+				continue
+			}
+		}
 		entry.Body = template.HTML(entryBody)
 
 		cont := content.Content{
@@ -59,18 +67,30 @@ func buildEntryPages(page config.Page) {
 			Collection:  page.Collection,
 			Entry:       entry,
 		}
+		setEntryNavigation(&cont, ents)
+		localizeContent(&cont)
 
-		primeDirectory(filepath.Join(cfg.OutputDir, page.Path))
+		outFile := filepath.Join(cfg.OutputDir, page.Path, entry.StaticFileName())
+		err = os.MkdirAll(filepath.Dir(outFile), 0755)
+		if err != nil {
+			report.Error("Error creating directory:", err)
+			continue
+		}
 
-		wr, err := os.Create(cfg.OutputDir + page.Path + "/" + entry.StaticFileName())
+		wr, err := os.Create(outFile)
 		if err != nil {
-			log.Println("Error creating file:", err)
-			return
+			report.Error("Error creating file:", err)
+			continue
 		}
 
-		err = templates.ExecuteTemplate(wr, "indexHTML", cont)
+		err = templates.ExecuteTemplate(wr, layoutTemplate(entry.Layout, page.Layout), cont)
 		if err != nil {
-			log.Println("Error executing template:", err)
+			report.Error("Error executing template for entry", page.Name+"/"+entry.FileName+":", err)
+		}
+		wr.Close()
+
+		if cfg.Site.SocialCards {
+			buildSocialCard(page, entry)
 		}
 	}
 }
@@ -78,7 +98,8 @@ func buildEntryPages(page config.Page) {
 // createContent creates a Content struct for a collection page.
 func createContent(page config.Page, ents []content.Entry) content.Content {
 	if len(ents) > 0 {
-		return content.Content{
+		ents = content.Entries(ents).Sort(page.SortBy, page.SortOrder)
+		cont := content.Content{
 			Site:        cfg.Site,
 			Page:        page,
 			RequestPath: page.Path,
@@ -88,9 +109,14 @@ func createContent(page config.Page, ents []content.Entry) content.Content {
 			Collection:  page.Collection,
 			Entries:     ents,
 		}
+		if page.Docs {
+			cont.DocsNav = content.Entries(ents).Tree()
+		}
+		localizeContent(&cont)
+		return cont
 	}
 
-	return content.Content{
+	cont := content.Content{
 		Site:        cfg.Site,
 		Page:        page,
 		RequestPath: page.Path,
@@ -102,6 +128,19 @@ func createContent(page config.Page, ents []content.Entry) content.Content {
 			Body: template.HTML("<b>No entries found</b><p>Please create a new entry in this page.</p>"),
 		},
 	}
+	localizeContent(&cont)
+	return cont
+}
+
+// setEntryNavigation sets the entries before and after the content's entry
+// in its collection along with the related entries, and the sidebar tree
+// for docs collections.
+func setEntryNavigation(cont *content.Content, ents content.Entries) {
+	cont.Prev, cont.Next = ents.Neighbours(cont.Entry)
+	cont.Related = ents.Related(cont.Entry, cfg.Site.Related)
+	if cont.Page.Docs {
+		cont.DocsNav = ents.Tree()
+	}
 }
 
 // findEntryByFilename finds an entry by filename in the collection.
@@ -116,40 +155,94 @@ func findEntryByFilename(ents []content.Entry, filename string) content.Entry {
 }
 
 // loadEntryBody loads the body of an entry.
-func loadEntryBody(page config.Page, entry content.Entry) string {
-	entryFilename := cfg.ContentDir + "/" + page.Name + "/" + entry.FileName // Updated here
+func loadEntryBody(page config.Page, entry content.Entry) (string, error) {
+	entryFilename, _ := localizedFile(page.Lang, filepath.Join(page.Name, entry.FileName))
 	md, err := os.ReadFile(entryFilename)
 	if err != nil {
-		log.Println(err)
-		return ""
+		return "", err
 	}
 
 	_, md, _ = content.ParseEntry(md)
-	renderer, p := newCustomizedRender(entry.IncludeToc, cfg.Site.Theme.SyntaxHighlight)
+	html, err := renderMarkdown(md, entry.IncludeToc)
+	if err != nil {
+		return string(html), fmt.Errorf("rendering %s: %w", entryFilename, err)
+	}
+
+	return string(html), nil
+}
 
-	mdString := string(md)
-	html := markdown.ToHTML([]byte(mdString), p, renderer)
+// collectionEntries returns the entries of a collection, from the loaded
+// entries in build mode or read from the content directory otherwise.
+func collectionEntries(page config.Page) content.Entries {
+	if ents, ok := entries[page.Name]; ok {
+		return ents
+	}
+
+	var ents content.Entries
+	for _, file := range collectionFiles(page) {
+		entry, ok := createEntry(page, page.Name, file, nil)
+		if ok && listed(page, entry) {
+			ents = append(ents, entry)
+		}
+	}
+	return ents.Sort(page.SortBy, page.SortOrder)
+}
+
+// collectionFiles returns the markdown files of a collection relative to its
+// directory, in the page's language. Docs collections include the files in
+// subdirectories.
+func collectionFiles(page config.Page) []string {
+	dir := filepath.Join(languageRoot(page.Lang), page.Name)
+	var files []string
+
+	if !page.Docs {
+		infos, _ := ioutil.ReadDir(dir)
+		for _, info := range infos {
+			if !info.IsDir() && strings.HasSuffix(info.Name(), ".md") {
+				files = append(files, info.Name())
+			}
+		}
+		return localizeFiles(files, page.Lang)
+	}
 
-	return string(html)
+	filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if !d.IsDir() && strings.HasSuffix(path, ".md") {
+			rel, _ := filepath.Rel(dir, path)
+			files = append(files, filepath.ToSlash(rel))
+		}
+		return nil
+	})
+	return localizeFiles(files, page.Lang)
 }
 
 func loadCollectionEntries(page config.Page) {
 
 	log.Println("Loading entries...")
-	files, _ := ioutil.ReadDir(filepath.Join(cfg.ContentDir, page.Name))
-
-	for _, file := range files {
-		filename := file.Name()
-		if strings.HasSuffix(filename, ".md") {
-			data, err := os.ReadFile(filepath.Join(cfg.ContentDir, page.Name, filename))
-			if err != nil {
-				log.Println("Error reading entry file:", err)
-				panic(err)
-			}
+	files := collectionFiles(page)
 
-			entry := createEntry(page, page.Name, filename, data)
-			entries[page.Name] = append(entries[page.Name], entry)
+	for _, filename := range files {
+		entry, ok := createEntry(page, page.Name, filename, nil)
+		if !ok {
+			continue
+		}
+		what := "entry " + page.Name + "/" + filename
+		if !checkAccessRule(what, entryAccess(page, entry, "")) {
+			continue
 		}
+		if !listed(page, entry) {
+			skipRestricted(what, entryAccess(page, entry, ""))
+			continue
+		}
+		entries[page.Name] = append(entries[page.Name], entry)
+	}
+
+	entries[page.Name] = content.Entries(entries[page.Name]).Sort(page.SortBy, page.SortOrder)
+
+	if len(entries[page.Name]) == 0 {
+		report.Warn("No entries found for collection", page.Name)
 	}
 
 	log.Println("Found", len(files), "entries")
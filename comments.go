@@ -0,0 +1,415 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"pubgo/content"
+)
+
+// maxAuthorLength is the longest name a comment may be posted under.
+const maxAuthorLength = 100
+
+// Comment is a comment left on an entry.
+type Comment struct {
+	ID       string    `json:"id"`
+	Path     string    `json:"path"`
+	Author   string    `json:"author"`
+	Body     string    `json:"body"`
+	Date     time.Time `json:"date"`
+	Approved bool      `json:"approved"`
+}
+
+// URL returns the address of the entry the comment is on.
+func (c Comment) URL() string {
+	return commentURL(c.Path)
+}
+
+// commentProvider renders the comment section of entries with
+// show_comments set. Providers are chosen with comments.provider.
+type commentProvider interface {
+	// Render returns the comment section of the entry cont renders.
+	Render(cont content.Content) (template.HTML, error)
+}
+
+var commentProviders = map[string]commentProvider{
+	"builtin":   builtinComments{},
+	"script":    embedComments{"commentsScriptHTML"},
+	"rantbrain": embedComments{"commentsRantbrainHTML"},
+	"none":      embedComments{},
+}
+
+var (
+	comments       = &commentStore{}
+	commentLimiter *rateLimiter
+)
+
+// renderComments renders the comment section of an entry with the
+// configured provider.
+//
+//	{{ comments . }}
+func renderComments(cont content.Content) (template.HTML, error) {
+	if cont.Comments != "" {
+		return cont.Comments, nil
+	}
+	provider, ok := commentProviders[cfg.Comments.Provider]
+	if !ok {
+		return "", fmt.Errorf("unknown comments provider %q", cfg.Comments.Provider)
+	}
+	return provider.Render(cont)
+}
+
+// embedComments renders a template embedding a third party comment
+// service, or nothing without one.
+type embedComments struct {
+	template string
+}
+
+func (p embedComments) Render(cont content.Content) (template.HTML, error) {
+	if p.template == "" {
+		return "", nil
+	}
+	return executeToHTML(p.template, struct {
+		content.Content
+		Script string
+	}{cont, cfg.Comments.Script})
+}
+
+// builtinComments renders the comments kept by the site along with a form
+// to post new ones while serving. Static builds show the approved comments
+// at the time of the build.
+type builtinComments struct{}
+
+func (builtinComments) Render(cont content.Content) (template.HTML, error) {
+	key := commentKey(cont.URL())
+	list, err := comments.List(key)
+	if err != nil {
+		return "", err
+	}
+	return executeToHTML("commentsBuiltinHTML", newCommentSection(key, cont.Lang, list))
+}
+
+// commentSection is the data of the commentsBuiltinHTML template.
+type commentSection struct {
+	Path      string
+	Lang      string
+	Comments  []Comment
+	Form      bool
+	MaxLength int
+	Message   string
+	Error     string
+	Author    string
+	Body      string
+}
+
+func newCommentSection(key, lang string, list []Comment) commentSection {
+	return commentSection{
+		Path:      key,
+		Lang:      lang,
+		Comments:  list,
+		Form:      cfg.Mode != "build",
+		MaxLength: cfg.Comments.MaxLength,
+	}
+}
+
+func executeToHTML(name string, data interface{}) (template.HTML, error) {
+	var buf bytes.Buffer
+	err := templates.ExecuteTemplate(&buf, name, data)
+	return template.HTML(buf.String()), err
+}
+
+// commentKey returns the key comments on the page at url are stored under,
+// its path without the extension, e.g. posts/hello_world.
+func commentKey(url string) string {
+	key := path.Clean("/" + url)
+	return strings.TrimPrefix(strings.TrimSuffix(key, path.Ext(key)), "/")
+}
+
+// commentURL returns the address of the entry comments under key are on,
+// built like the links to entries from the base path, the entry's language
+// prefix and its page.
+func commentURL(key string) string {
+	lang, rest := splitLanguage("/" + key)
+	return cfg.BaseURL + languagePrefix(lang) + rest + ".html"
+}
+
+// commentable reports whether key belongs to an entry taking comments
+// which the visitor of r may see, checked like the route of the entry.
+func commentable(r *http.Request, key string) bool {
+	if key == "" {
+		return false
+	}
+	lang, rest := splitLanguage("/" + key + ".html")
+	if isSinglePage(rest) || privatePath(rest) {
+		return false
+	}
+	file, err := parseRoute(rest, lang)
+	if err != nil || isDir(file) {
+		return false
+	}
+	if !accessGranted(r, routeAccess(rest, lang, file)) {
+		return false
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return false
+	}
+	entry, _, _ := content.ParseEntry(data)
+	return entry.ShowComments
+}
+
+// commentStore keeps the comments of each entry in a JSON file below
+// <content_dir>/comments named after the entry's path.
+type commentStore struct {
+	sync.Mutex
+}
+
+func (s *commentStore) dir() string {
+	return filepath.Join(cfg.ContentDir, "comments")
+}
+
+func (s *commentStore) file(key string) string {
+	return filepath.Join(s.dir(), filepath.FromSlash(key)+".json")
+}
+
+func (s *commentStore) load(key string) ([]Comment, error) {
+	data, err := os.ReadFile(s.file(key))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var list []Comment
+	err = json.Unmarshal(data, &list)
+	return list, err
+}
+
+// save writes the comments of key through a temporary file so readers never
+// see a partly written list.
+func (s *commentStore) save(key string, list []Comment) error {
+	file := s.file(key)
+	err := os.MkdirAll(filepath.Dir(file), 0755)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := file + ".tmp"
+	err = os.WriteFile(tmp, data, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
+
+// List returns the approved comments of key, oldest first.
+func (s *commentStore) List(key string) ([]Comment, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	all, err := s.load(key)
+	if err != nil {
+		return nil, err
+	}
+
+	var list []Comment
+	for _, c := range all {
+		if c.Approved {
+			list = append(list, c)
+		}
+	}
+	return list, nil
+}
+
+// Add stores a new comment.
+func (s *commentStore) Add(c Comment) error {
+	s.Lock()
+	defer s.Unlock()
+
+	list, err := s.load(c.Path)
+	if err != nil {
+		return err
+	}
+	return s.save(c.Path, append(list, c))
+}
+
+// All returns the comments of every entry, newest first.
+func (s *commentStore) All() ([]Comment, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	var all []Comment
+	err := filepath.WalkDir(s.dir(), func(file string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() || filepath.Ext(file) != ".json" {
+			return nil
+		}
+
+		rel, _ := filepath.Rel(s.dir(), file)
+		list, err := s.load(strings.TrimSuffix(filepath.ToSlash(rel), ".json"))
+		if err != nil {
+			return err
+		}
+		all = append(all, list...)
+		return nil
+	})
+
+	sort.SliceStable(all, func(i, j int) bool {
+		return all[i].Date.After(all[j].Date)
+	})
+	return all, err
+}
+
+// Moderate approves or deletes the comment id of key.
+func (s *commentStore) Moderate(key, id string, approve bool) error {
+	s.Lock()
+	defer s.Unlock()
+
+	list, err := s.load(key)
+	if err != nil {
+		return err
+	}
+
+	for i, c := range list {
+		if c.ID != id {
+			continue
+		}
+		if approve {
+			list[i].Approved = true
+		} else {
+			list = append(list[:i], list[i+1:]...)
+		}
+		return s.save(key, list)
+	}
+	return fmt.Errorf("no comment %s on %s", id, key)
+}
+
+// setupCommentRoutes registers the handler taking new comments.
+func setupCommentRoutes() {
+	commentLimiter = newRateLimiter(cfg.Comments.RateLimit, 10*time.Minute)
+
+	http.HandleFunc("/comments", func(w http.ResponseWriter, r *http.Request) {
+		logRequest(r)
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if cfg.Comments.Provider != "builtin" {
+			http.NotFound(w, r)
+			return
+		}
+		postComment(w, r)
+	})
+}
+
+// postComment stores a comment posted with the form of the builtin
+// provider. htmx requests get the updated comment section back, plain form
+// posts are redirected to the entry, or shown it again with the problem.
+func postComment(w http.ResponseWriter, r *http.Request) {
+	key := commentKey(r.PostFormValue("path"))
+	if !commentable(r, key) {
+		http.Error(w, "Comments are closed", http.StatusNotFound)
+		return
+	}
+
+	lang, _ := splitLanguage("/" + key)
+	section := newCommentSection(key, lang, nil)
+	section.Author = strings.TrimSpace(r.PostFormValue("author"))
+	section.Body = strings.TrimSpace(strings.ReplaceAll(r.PostFormValue("body"), "\r\n", "\n"))
+
+	switch {
+	// bots fill in the field hidden from people, pretend it worked
+	case r.PostFormValue("website") != "":
+		log.Println("Dropped comment on", key, "from", clientIP(r)+", honeypot filled in")
+		section.Message = i18n("Thanks! Your comment will appear once it is approved.", lang)
+		section.Author, section.Body = "", ""
+	case !commentLimiter.Allow(clientIP(r)):
+		section.Error = i18n("Too many comments, please try again later.", lang)
+	case section.Author == "" || section.Body == "":
+		section.Error = i18n("Please enter your name and a comment.", lang)
+	case utf8.RuneCountInString(section.Author) > maxAuthorLength || utf8.RuneCountInString(section.Body) > cfg.Comments.MaxLength:
+		section.Error = i18n("Your name or comment is too long.", lang)
+	default:
+		c := Comment{
+			ID:       randomID(8),
+			Path:     key,
+			Author:   section.Author,
+			Body:     section.Body,
+			Date:     time.Now(),
+			Approved: !cfg.Comments.Moderation,
+		}
+		err := comments.Add(c)
+		if err != nil {
+			log.Println("Error storing comment:", err)
+			http.Error(w, "Error storing comment", http.StatusInternalServerError)
+			return
+		}
+		log.Println("New comment", c.ID, "on", key)
+
+		if c.Approved {
+			section.Message = i18n("Thanks for your comment!", lang)
+		} else {
+			section.Message = i18n("Thanks! Your comment will appear once it is approved.", lang)
+		}
+		section.Author, section.Body = "", ""
+	}
+
+	if r.Header.Get("HX-Request") != "true" && section.Error == "" {
+		http.Redirect(w, r, commentURL(key)+"#comments", http.StatusSeeOther)
+		return
+	}
+
+	list, err := comments.List(key)
+	if err != nil {
+		log.Println("Error loading comments:", err)
+	}
+	section.Comments = list
+
+	// htmx only swaps in successful responses, so problems are reported in
+	// the returned section rather than with the status
+	if r.Header.Get("HX-Request") == "true" {
+		executeTemplate(w, 0, "commentsBuiltinHTML", section)
+		return
+	}
+
+	html, err := executeToHTML("commentsBuiltinHTML", section)
+	if err != nil {
+		log.Println("Error executing template:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	entryRequest := r.Clone(r.Context())
+	entryRequest.URL.Path = "/" + key + ".html"
+	_, rest := splitLanguage(entryRequest.URL.Path)
+	file, err := parseRoute(rest, lang)
+	if err != nil {
+		http.Error(w, "Comments are closed", http.StatusNotFound)
+		return
+	}
+	renderEntry(w, entryRequest, file, html)
+}
@@ -3,33 +3,101 @@ package config
 import (
 	"log"
 	"os"
+	"sort"
+	"strings"
 
 	"gopkg.in/yaml.v2"
 )
 
+// ColorScheme is an alternative set of theme colors, used for the dark
+// color scheme.
+type ColorScheme struct {
+	Fg          string `yaml:"text"`
+	Bg          string `yaml:"main"`
+	Accent      string `yaml:"accent"`
+	MutedAccent string `yaml:"muted_accent"`
+	SyntaxTheme string `yaml:"syntax_theme"`
+}
+
 type Theme struct {
-	BackgroundColor string `yaml:"background"`
-	Fg              string `yaml:"text"`
-	Bg              string `yaml:"main"`
-	Accent          string `yaml:"accent"`
-	MutedAccent     string `yaml:"muted_accent"`
-	MainFont        string `yaml:"font_family"`
-	SyntaxHighlight bool   `yaml:"syntax_highlight"`
-	SyntaxTheme     string `yaml:"syntax_theme"`
+	BackgroundColor string      `yaml:"background"`
+	Fg              string      `yaml:"text"`
+	Bg              string      `yaml:"main"`
+	Accent          string      `yaml:"accent"`
+	MutedAccent     string      `yaml:"muted_accent"`
+	MainFont        string      `yaml:"font_family"`
+	SyntaxHighlight bool        `yaml:"syntax_highlight"`
+	SyntaxTheme     string      `yaml:"syntax_theme"`
+	CodeCopy        bool        `yaml:"code_copy"`
+	Math            string      `yaml:"math"`
+	MathRender      string      `yaml:"math_render"`
+	Mermaid         bool        `yaml:"mermaid"`
+	Scheme          string      `yaml:"scheme"`
+	Dark            ColorScheme `yaml:"dark"`
+}
+
+// Related configures how related entries are picked: each shared tag adds
+// tags to an entry's score and the similarity of the titles and descriptions,
+// from 0 to 1, adds keywords times that. Entries scoring below threshold are
+// left out.
+type Related struct {
+	Count     int     `yaml:"count"`
+	Tags      float64 `yaml:"tags"`
+	Keywords  float64 `yaml:"keywords"`
+	Threshold float64 `yaml:"threshold"`
+}
+
+// MenuItem is an entry of a menu. URL may point at a page of the site or
+// another site, Children make up a submenu.
+type MenuItem struct {
+	Name     string     `yaml:"name"`
+	URL      string     `yaml:"url"`
+	Weight   int        `yaml:"weight"`
+	Children []MenuItem `yaml:"children"`
+}
+
+// External reports whether the item links to another site.
+func (m MenuItem) External() bool {
+	return strings.HasPrefix(m.URL, "http://") || strings.HasPrefix(m.URL, "https://") || strings.HasPrefix(m.URL, "//")
+}
+
+// sortMenu orders menu items and their submenus by weight.
+func sortMenu(items []MenuItem) {
+	sort.SliceStable(items, func(i, j int) bool {
+		return items[i].Weight < items[j].Weight
+	})
+	for _, item := range items {
+		sortMenu(item.Children)
+	}
 }
 
 type Site struct {
-	Name          string `yaml:"name"`
-	Logo          string `yaml:"logo"`
-	LogoText      string `yaml:"logo_text"`
-	LogoWidth     string `yaml:"logo_width"`
-	LogoHeight    string `yaml:"logo_height"`
-	Pages         Pages  `yaml:"pages"`
-	Theme         Theme  `yaml:"theme"`
-	Title         string `yaml:"title"`
-	FooterContent string `yaml:"footer_content"`
-	Favicon       string `yaml:"favicon"`
-	Stylesheet    string `yaml:"stylesheet"`
+	Name          string  `yaml:"name"`
+	ThemeName     string  `yaml:"theme_name"`
+	Locale        string  `yaml:"locale"`
+	Logo          string  `yaml:"logo"`
+	LogoText      string  `yaml:"logo_text"`
+	LogoWidth     string  `yaml:"logo_width"`
+	LogoHeight    string  `yaml:"logo_height"`
+	Pages         Pages   `yaml:"pages"`
+	Theme         Theme   `yaml:"theme"`
+	Title         string  `yaml:"title"`
+	Description   string  `yaml:"description"`
+	Image         string  `yaml:"image"`
+	Twitter       string  `yaml:"twitter"`
+	SocialCards   bool    `yaml:"social_cards"`
+	FooterContent string  `yaml:"footer_content"`
+	Favicon       string  `yaml:"favicon"`
+	Stylesheet    string  `yaml:"stylesheet"`
+	TocRail       bool    `yaml:"toc_rail"`
+	Related       Related `yaml:"related"`
+
+	Menus map[string][]MenuItem `yaml:"menus"`
+
+	// URL is the address the site is published at, e.g.
+	// https://example.com, which canonical and Open Graph URLs start with.
+	// base_url is only the path the site is served below.
+	URL string `yaml:"url"`
 }
 
 type Hero struct {
@@ -45,26 +113,169 @@ type Page struct {
 	Path        string `yaml:"path"`
 	HideFromNav bool   `yaml:"hide_from_nav"`
 	Collection  bool   `yaml:"collection"`
+	Docs        bool   `yaml:"docs"`
+	Breadcrumb  bool   `yaml:"breadcrumb"`
+	Layout      string `yaml:"layout"`
+	SortBy      string `yaml:"sort_by"`
+	SortOrder   string `yaml:"sort_order"`
 	Hero        Hero   `yaml:"hero"`
+
+	// Access is who may see the page and its entries: public, the default,
+	// authenticated for signed in users or password for anyone with the
+	// password whose bcrypt hash is Password.
+	Access   string `yaml:"access"`
+	Password string `yaml:"password"`
+
+	// Lang is the language the page is being published in, set for
+	// multilingual sites.
+	Lang string `yaml:"-"`
 }
 
 type Pages map[string]Page
 
+// Check configures the link checker used by the check run mode. With
+// External, links to other sites on AllowedHosts and their subdomains are
+// requested too; left empty, no other site is.
+type Check struct {
+	External     bool     `yaml:"external"`
+	AllowedHosts []string `yaml:"allowed_hosts"`
+}
+
+// Comments configures the comment section of entries with show_comments.
+// The builtin provider keeps comments in <content_dir>/comments and takes
+// new ones while serving, others embed a third party service with Script.
+// With Moderation new comments wait for approval in /admin, RateLimit is
+// the number of comments a client may post in ten minutes.
+type Comments struct {
+	Provider   string `yaml:"provider"`
+	Script     string `yaml:"script"`
+	Moderation bool   `yaml:"moderation"`
+	RateLimit  int    `yaml:"rate_limit"`
+	MaxLength  int    `yaml:"max_length"`
+}
+
+// Form is a form the server takes submissions of at /forms/<name>. They
+// are stored in <content_dir>/forms/<name> and delivered by email to To
+// and as JSON to Webhook.
+type Form struct {
+	Title   string      `yaml:"title"`
+	Fields  []FormField `yaml:"fields"`
+	Submit  string      `yaml:"submit"`
+	Success string      `yaml:"success"`
+	To      []string    `yaml:"to"`
+	Subject string      `yaml:"subject"`
+	Webhook string      `yaml:"webhook"`
+}
+
+// FormField is an input of a form. Type is one of text, textarea, email,
+// url, tel, number, checkbox or select, which takes Options.
+type FormField struct {
+	Name      string   `yaml:"name"`
+	Label     string   `yaml:"label"`
+	Type      string   `yaml:"type"`
+	Required  bool     `yaml:"required"`
+	MaxLength int      `yaml:"max_length"`
+	Pattern   string   `yaml:"pattern"`
+	Options   []string `yaml:"options"`
+}
+
+// SMTP is the mail server forms are delivered through.
+type SMTP struct {
+	Host     string `yaml:"host"`
+	Port     int    `yaml:"port"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	From     string `yaml:"from"`
+}
+
+// Admin configures the admin at /admin. Users and their password hashes
+// are kept in UsersFile, which pubgo user adds to, and logins and changes
+// are recorded in AuditLog. LoginRateLimit is the number of logins a client
+// may attempt in fifteen minutes.
+type Admin struct {
+	UsersFile      string `yaml:"users_file"`
+	AuditLog       string `yaml:"audit_log"`
+	SessionHours   int    `yaml:"session_hours"`
+	LoginRateLimit int    `yaml:"login_rate_limit"`
+}
+
+// Git keeps the history of the content directory in a git repository,
+// created when the directory isn't one yet. Edits made in the admin are
+// committed under the name of the user who made them.
+//
+// With a WebhookSecret, pushes to Branch of the Remote repository are
+// deployed when /hooks/deploy receives a signed GitHub or Gitea webhook:
+// the content directory pulls them, the templates and translations are
+// reloaded and with Build the static site is rebuilt into the output
+// directory.
+type Git struct {
+	Enabled       bool   `yaml:"enabled"`
+	Remote        string `yaml:"remote"`
+	Branch        string `yaml:"branch"`
+	WebhookSecret string `yaml:"webhook_secret"`
+	Build         bool   `yaml:"build"`
+}
+
+// Language is a language the site is published in. Its content comes from
+// files suffixed with the language code, like hello.de.md, or from its own
+// content_dir inside the site's.
+type Language struct {
+	Name        string `yaml:"name"`
+	Weight      int    `yaml:"weight"`
+	ContentDir  string `yaml:"content_dir"`
+	Title       string `yaml:"title"`
+	Description string `yaml:"description"`
+	Locale      string `yaml:"locale"`
+}
+
 type Config struct {
 	ContentDir string `yaml:"content_dir"`
 	BaseURL    string `yaml:"base_url"`
 	OutputDir  string `yaml:"-"`
-	AdminUser  string `yaml:"admin_user"`
-	AdminPass  string `yaml:"admin_pass"`
 	Mode       string `yaml:"-"`
+	Strict     bool   `yaml:"-"`
+	Clean      bool   `yaml:"-"`
+	Dev        bool   `yaml:"-"`
 	Port       int    `yaml:"port"`
 	Site       Site   `yaml:"site"`
+	Check      Check  `yaml:"check"`
+
+	Admin    Admin           `yaml:"admin"`
+	Git      Git             `yaml:"git"`
+	Comments Comments        `yaml:"comments"`
+	Forms    map[string]Form `yaml:"forms"`
+	SMTP     SMTP            `yaml:"smtp"`
+
+	// FormRateLimit is the number of form submissions a client may send
+	// in ten minutes.
+	FormRateLimit int `yaml:"form_rate_limit"`
+
+	Languages       map[string]Language `yaml:"languages"`
+	DefaultLanguage string              `yaml:"default_language"`
+
+	// AdminUser and AdminPass are no longer used and only kept to warn
+	// configs still setting them. Users are added to Admin.UsersFile.
+	AdminUser string `yaml:"admin_user,omitempty"`
+	AdminPass string `yaml:"admin_pass,omitempty"`
 }
 
 func NewConfig() Config {
 	cfg := Config{
 		BaseURL: "",
 		Port:    8080,
+		Admin: Admin{
+			UsersFile:      "users.yaml",
+			AuditLog:       "audit.log",
+			SessionHours:   12,
+			LoginRateLimit: 5,
+		},
+		Comments: Comments{
+			Provider:   "builtin",
+			Moderation: true,
+			RateLimit:  5,
+			MaxLength:  5000,
+		},
+		FormRateLimit: 5,
 		Site: Site{
 			Name:          "My Site",
 			FooterContent: "CopyRight © 2019 My Site",
@@ -95,6 +306,12 @@ func NewConfig() Config {
 				SyntaxHighlight: false,
 				SyntaxTheme:     "dracula",
 			},
+			Related: Related{
+				Count:     3,
+				Tags:      1,
+				Keywords:  1,
+				Threshold: 0.2,
+			},
 		},
 	}
 
@@ -138,4 +355,27 @@ func LoadConfig(filename string, cfg *Config) {
 		log.Println("Error unmarshalling config:", err)
 		panic(err)
 	}
+
+	for _, menu := range cfg.Site.Menus {
+		sortMenu(menu)
+	}
+}
+
+// LoadTheme reads the theme section of the config file over theme, so that
+// settings in the config file take precedence over an installed theme's
+// defaults.
+func LoadTheme(filename string, theme *Theme) error {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+
+	overrides := struct {
+		Site struct {
+			Theme *Theme `yaml:"theme"`
+		} `yaml:"site"`
+	}{}
+	overrides.Site.Theme = theme
+
+	return yaml.Unmarshal(data, &overrides)
 }
@@ -0,0 +1,112 @@
+package content
+
+import (
+	"encoding/json"
+	"html/template"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// Breadcrumb is a step on the path from the home page to the current page.
+type Breadcrumb struct {
+	Name     string
+	URL      string
+	Position int
+}
+
+// Breadcrumbs returns the trail from the home page through the collection,
+// and the directories of a docs collection, to the current entry. The last
+// breadcrumb is the current page.
+func (c Content) Breadcrumbs() []Breadcrumb {
+	var crumbs []Breadcrumb
+	add := func(name, url string) {
+		crumbs = append(crumbs, Breadcrumb{Name: name, URL: url, Position: len(crumbs) + 1})
+	}
+
+	// the home page of the page's language, e.g. /de/
+	homePath := c.LangPath + "/"
+	home := "home"
+	for _, p := range c.Site.Pages {
+		if p.Path == homePath {
+			home = p.Name
+		}
+	}
+	add(home, c.BasePath+homePath)
+
+	if c.Page.Path == "" || c.Page.Path == homePath {
+		return crumbs
+	}
+	pagePath := strings.TrimSuffix(c.Page.Path, "/")
+	add(c.Page.Name, c.BasePath+pagePath)
+
+	if !c.Page.Collection || c.Entry.FileName == "" {
+		return crumbs
+	}
+
+	// directories of docs collections link to their index entry if they
+	// have one
+	nodes := c.DocsNav
+	dirs := strings.Split(path.Dir(c.Entry.FileName), "/")
+	for i, dir := range dirs {
+		if dir == "." {
+			break
+		}
+		name, url := dirTitle(dir), ""
+		for _, n := range nodes {
+			if n.Children == nil || !n.Contains(c.Entry.FileName) {
+				continue
+			}
+			name = n.Title
+			if n.Entry != nil {
+				url = c.BasePath + pagePath + "/" + n.Entry.StaticFileName()
+			}
+			nodes = n.Children
+			break
+		}
+		if strings.TrimSuffix(path.Base(c.Entry.FileName), path.Ext(c.Entry.FileName)) == "index" && i == len(dirs)-1 {
+			// the entry is this directory's index, it is added below
+			break
+		}
+		add(name, url)
+	}
+
+	add(c.Entry.Title, c.BasePath+pagePath+"/"+c.Entry.StaticFileName())
+	return crumbs
+}
+
+// BreadcrumbJSON returns the breadcrumbs as a schema.org BreadcrumbList for
+// a JSON-LD script. Their items need absolute URLs, so they are left out
+// unless site.url is set.
+func (c Content) BreadcrumbJSON() template.JS {
+	origin := ""
+	if u, err := url.Parse(c.Site.URL); err == nil && u.Host != "" {
+		origin = u.Scheme + "://" + u.Host
+	}
+
+	type listItem struct {
+		Type     string `json:"@type"`
+		Position int    `json:"position"`
+		Name     string `json:"name"`
+		Item     string `json:"item,omitempty"`
+	}
+
+	var items []listItem
+	for _, crumb := range c.Breadcrumbs() {
+		item := listItem{Type: "ListItem", Position: crumb.Position, Name: crumb.Name}
+		if origin != "" && crumb.URL != "" {
+			item.Item = origin + crumb.URL
+		}
+		items = append(items, item)
+	}
+
+	data, err := json.Marshal(map[string]interface{}{
+		"@context":        "https://schema.org",
+		"@type":           "BreadcrumbList",
+		"itemListElement": items,
+	})
+	if err != nil {
+		return ""
+	}
+	return template.JS(data)
+}
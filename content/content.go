@@ -23,15 +23,29 @@ type Entry struct {
 	Date        time.Time `yaml:"date"`
 	Author      string    `yaml:"author"`
 	Description string    `yaml:"description"`
+	Image       string    `yaml:"image"`
+	Layout      string    `yaml:"layout"`
+	Weight      int       `yaml:"weight"`
+	Pinned      bool      `yaml:"pinned"`
+	Featured    bool      `yaml:"featured"`
+	Tags        []string  `yaml:"tags"`
 
 	IncludeToc   bool `yaml:"include_toc"`
 	ShowComments bool `yaml:"show_comments"`
+
+	// Access and Password override those of the entry's page.
+	Access   string `yaml:"access"`
+	Password string `yaml:"password"`
 }
 
 func (e Entry) StaticFileName() string {
 	return strings.Replace(e.FileName, ".md", ".html", 1)
 }
 
+// ErrNoFrontMatter is returned by ParseEntry when the data has no yaml
+// front matter block.
+var ErrNoFrontMatter = errors.New("No yaml found")
+
 // Entries is a slice of Entry
 type Entries []Entry
 
@@ -47,6 +61,66 @@ func (e Entries) SortByDate() Entries {
 	return entries
 }
 
+// Sort returns the entries ordered by date, title, weight or filename, in
+// ascending or descending order, ascending unless order is "desc". Pinned
+// entries always come first and entries without a weight come after
+// weighted ones.
+func (e Entries) Sort(by, order string) Entries {
+	entries := make(Entries, len(e))
+	copy(entries, e)
+
+	if by == "" {
+		by = "date"
+	}
+	desc := order == "desc"
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+		if a.Pinned != b.Pinned {
+			return a.Pinned
+		}
+
+		var cmp int
+		switch by {
+		case "title":
+			cmp = strings.Compare(strings.ToLower(a.Title), strings.ToLower(b.Title))
+		case "weight":
+			if (a.Weight == 0) != (b.Weight == 0) {
+				return a.Weight != 0
+			}
+			cmp = a.Weight - b.Weight
+		case "filename":
+			cmp = strings.Compare(a.FileName, b.FileName)
+		default:
+			if a.Date.Before(b.Date) {
+				cmp = -1
+			} else if a.Date.After(b.Date) {
+				cmp = 1
+			}
+		}
+		if cmp == 0 {
+			// keep the order stable between builds
+			return a.FileName < b.FileName
+		}
+		if desc {
+			return cmp > 0
+		}
+		return cmp < 0
+	})
+	return entries
+}
+
+// Featured returns the entries marked as featured.
+func (e Entries) Featured() Entries {
+	var entries Entries
+	for _, entry := range e {
+		if entry.Featured {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
 // Page is the data passed to the template
 type Content struct {
 	Site        config.Site
@@ -58,6 +132,47 @@ type Content struct {
 	Collection  bool
 	Entry       Entry
 	Entries     Entries
+	Prev        *Entry
+	Next        *Entry
+	Related     Entries
+	DocsNav     []*NavNode
+
+	// Comments is the comment section of the entry when it was rendered
+	// ahead, e.g. to show why a posted comment was rejected.
+	Comments template.HTML
+
+	// Lang is the language of the page on multilingual sites and LangPath
+	// its URL prefix, empty for the default language. Translations are the
+	// languages the page is available in, the current one included.
+	Lang         string
+	LangPath     string
+	Translations []Translation
+}
+
+// Translation is a version of a page in one of the site's languages.
+type Translation struct {
+	Lang    string
+	Name    string
+	URL     string
+	Current bool
+	Default bool
+}
+
+// URL returns the path of the page being rendered: the entry's for
+// collection entries, otherwise the page's.
+func (c Content) URL() string {
+	if c.Page.Collection && c.Entry.FileName != "" {
+		return strings.TrimSuffix(c.Page.Path, "/") + "/" + c.Entry.StaticFileName()
+	}
+	if c.Page.Path != "" {
+		return c.Page.Path
+	}
+	return c.RequestPath
+}
+
+// CardURL returns the path of a collection entry's social card image.
+func (c Content) CardURL() string {
+	return strings.TrimSuffix(c.URL(), ".html") + ".png"
 }
 
 // ParseEntry parses a file and returns an Entry struct
@@ -68,11 +183,11 @@ func ParseEntry(data []byte) (Entry, []byte, error) {
 
 	yamlStart := bytes.Index(data, []byte("---"))
 	if yamlStart < 0 {
-		return entry, data, errors.New("No yaml found")
+		return entry, data, ErrNoFrontMatter
 	}
 	yamlEnd := bytes.Index(data[yamlStart+3:], []byte("---"))
 	if yamlEnd < 0 {
-		return entry, data, errors.New("No yaml found")
+		return entry, data, ErrNoFrontMatter
 	}
 	err := yaml.Unmarshal(data[yamlStart+3:yamlStart+3+yamlEnd], &entry)
 
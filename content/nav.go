@@ -0,0 +1,120 @@
+package content
+
+import (
+	"html"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var (
+	headingPattern = regexp.MustCompile(`(?s)<h([23]) id="([^"]+)">(.*?)</h[23]>`)
+	tagPattern     = regexp.MustCompile(`<[^>]*>`)
+)
+
+// NavNode is an entry or a directory in the navigation tree of a docs
+// collection.
+type NavNode struct {
+	Title    string
+	Entry    *Entry
+	Children []*NavNode
+
+	order int
+}
+
+// Contains reports whether the node or any node below it is the entry with
+// the given file name.
+func (n *NavNode) Contains(fileName string) bool {
+	if n.Entry != nil && n.Entry.FileName == fileName {
+		return true
+	}
+	for _, child := range n.Children {
+		if child.Contains(fileName) {
+			return true
+		}
+	}
+	return false
+}
+
+// Tree arranges entries with file names like guide/install.md into a tree
+// following their directories. An index.md in a directory gives the
+// directory its title and link. Nodes keep the order of the entries, a
+// directory sorting where its index.md or else its first entry would.
+func (e Entries) Tree() []*NavNode {
+	root := &NavNode{}
+	dirs := map[string]*NavNode{".": root}
+
+	var dirNode func(dir string, order int) *NavNode
+	dirNode = func(dir string, order int) *NavNode {
+		if n, ok := dirs[dir]; ok {
+			return n
+		}
+		parent := dirNode(path.Dir(dir), order)
+		n := &NavNode{Title: dirTitle(path.Base(dir)), order: order}
+		parent.Children = append(parent.Children, n)
+		dirs[dir] = n
+		return n
+	}
+
+	for i := range e {
+		name := strings.ReplaceAll(e[i].FileName, "\\", "/")
+		dir := path.Dir(name)
+		base := strings.TrimSuffix(path.Base(name), path.Ext(name))
+
+		if base == "index" && dir != "." {
+			n := dirNode(dir, i)
+			n.Title = e[i].Title
+			n.Entry = &e[i]
+			n.order = i
+			continue
+		}
+
+		parent := dirNode(dir, i)
+		parent.Children = append(parent.Children, &NavNode{Title: e[i].Title, Entry: &e[i], order: i})
+	}
+
+	sortNodes(root.Children)
+	return root.Children
+}
+
+func sortNodes(nodes []*NavNode) {
+	sort.SliceStable(nodes, func(i, j int) bool {
+		return nodes[i].order < nodes[j].order
+	})
+	for _, n := range nodes {
+		sortNodes(n.Children)
+	}
+}
+
+// dirTitle turns a directory name like getting-started into Getting started.
+func dirTitle(name string) string {
+	name = strings.NewReplacer("-", " ", "_", " ").Replace(name)
+	if name == "" {
+		return name
+	}
+	return strings.ToUpper(name[:1]) + name[1:]
+}
+
+// Heading is a section heading of an entry's body.
+type Heading struct {
+	Level int
+	ID    string
+	Title string
+}
+
+// Headings returns the second and third level headings of the rendered
+// body, those given IDs by the markdown renderer.
+func (e Entry) Headings() []Heading {
+	var headings []Heading
+	for _, m := range headingPattern.FindAllStringSubmatch(string(e.Body), -1) {
+		level, _ := strconv.Atoi(m[1])
+		headings = append(headings, Heading{
+			Level: level,
+			ID:    html.UnescapeString(m[2]),
+			Title: html.UnescapeString(tagPattern.ReplaceAllString(m[3], "")),
+		})
+	}
+	return headings
+}
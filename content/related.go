@@ -0,0 +1,102 @@
+package content
+
+import (
+	"sort"
+	"strings"
+	"unicode"
+
+	"pubgo/config"
+)
+
+// Neighbours returns the entries before and after entry in e, nil at either
+// end of the collection.
+func (e Entries) Neighbours(entry Entry) (prev, next *Entry) {
+	for i := range e {
+		if e[i].FileName != entry.FileName {
+			continue
+		}
+		if i > 0 {
+			prev = &e[i-1]
+		}
+		if i < len(e)-1 {
+			next = &e[i+1]
+		}
+		break
+	}
+	return prev, next
+}
+
+// Related returns the entries of e most similar to entry, scored by the tags
+// they share and how alike their titles and descriptions are.
+func (e Entries) Related(entry Entry, opts config.Related) Entries {
+	type scored struct {
+		entry Entry
+		score float64
+	}
+
+	words := keywords(entry)
+	var candidates []scored
+	for _, other := range e {
+		if other.FileName == entry.FileName {
+			continue
+		}
+
+		score := opts.Tags*float64(sharedTags(entry.Tags, other.Tags)) +
+			opts.Keywords*similarity(words, keywords(other))
+		if score > 0 && score >= opts.Threshold {
+			candidates = append(candidates, scored{other, score})
+		}
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].score > candidates[j].score
+	})
+
+	var related Entries
+	for i := 0; i < len(candidates) && i < opts.Count; i++ {
+		related = append(related, candidates[i].entry)
+	}
+	return related
+}
+
+func sharedTags(a, b []string) int {
+	var n int
+	for _, x := range a {
+		for _, y := range b {
+			if strings.EqualFold(x, y) {
+				n++
+				break
+			}
+		}
+	}
+	return n
+}
+
+// keywords returns the words of an entry's title and description, leaving
+// out short words which are mostly articles and prepositions.
+func keywords(entry Entry) map[string]bool {
+	words := make(map[string]bool)
+	fields := strings.FieldsFunc(strings.ToLower(entry.Title+" "+entry.Description), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+	for _, w := range fields {
+		if len(w) > 3 {
+			words[w] = true
+		}
+	}
+	return words
+}
+
+// similarity is the Jaccard index of two sets of words.
+func similarity(a, b map[string]bool) float64 {
+	if len(a) == 0 || len(b) == 0 {
+		return 0
+	}
+	var common int
+	for w := range a {
+		if b[w] {
+			common++
+		}
+	}
+	return float64(common) / float64(len(a)+len(b)-common)
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// csrfCookie holds the random id CSRF tokens of visitors without a
+	// session are bound to.
+	csrfCookie = "pubgo_csrf"
+	// csrfField is the form field carrying the token.
+	csrfField = "csrf_token"
+	// csrfTTL is how long a token stays valid.
+	csrfTTL = 12 * time.Hour
+)
+
+// csrfSecret signs CSRF tokens. It is made at start up, so tokens handed
+// out before a restart stop working.
+var csrfSecret = randomBytes(32)
+
+func randomBytes(n int) []byte {
+	b := make([]byte, n)
+	_, err := rand.Read(b)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// randomID returns a random hex string of n bytes.
+func randomID(n int) string {
+	return hex.EncodeToString(randomBytes(n))
+}
+
+// csrfToken returns a token allowing the holder of id, a cookie or session
+// only they have, to post to action.
+func csrfToken(id, action string) string {
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	return ts + "." + csrfSignature(id, action, ts)
+}
+
+// validCSRFToken reports whether token was made for id and action and
+// hasn't expired.
+func validCSRFToken(token, id, action string) bool {
+	ts, sig, ok := strings.Cut(token, ".")
+	if !ok || id == "" {
+		return false
+	}
+	unix, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil || time.Since(time.Unix(unix, 0)) > csrfTTL {
+		return false
+	}
+	return hmac.Equal([]byte(sig), []byte(csrfSignature(id, action, ts)))
+}
+
+func csrfSignature(id, action, ts string) string {
+	mac := hmac.New(sha256.New, csrfSecret)
+	mac.Write([]byte(id + "\x00" + action + "\x00" + ts))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// csrfID returns the visitor's CSRF cookie, setting a new one if they
+// don't have one yet.
+func csrfID(w http.ResponseWriter, r *http.Request) string {
+	if c, err := r.Cookie(csrfCookie); err == nil && c.Value != "" {
+		return c.Value
+	}
+
+	id := randomID(16)
+	http.SetCookie(w, &http.Cookie{
+		Name:     csrfCookie,
+		Value:    id,
+		Path:     "/",
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return id
+}
+
+// checkCSRF reports whether a posted form carries a valid token for action
+// and the visitor's CSRF cookie.
+func checkCSRF(r *http.Request, action string) bool {
+	c, err := r.Cookie(csrfCookie)
+	if err != nil {
+		return false
+	}
+	return validCSRFToken(r.PostFormValue(csrfField), c.Value, action)
+}
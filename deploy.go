@@ -0,0 +1,515 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	gitconfig "github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+// siteMu is held for reading while serving a request and for writing while
+// a deploy swaps in the new templates and site, so no request sees half of
+// them.
+var siteMu sync.RWMutex
+
+// lockedHandler serves requests while no deploy is reloading the site.
+// Form submissions take the lock themselves, only while rendering, so
+// deliveries to slow mail servers and webhooks don't hold up a deploy.
+func lockedHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/forms/") {
+			h.ServeHTTP(w, r)
+			return
+		}
+		siteMu.RLock()
+		defer siteMu.RUnlock()
+		h.ServeHTTP(w, r)
+	})
+}
+
+// DeployStatus is the outcome of the last deploy, shown in the admin.
+type DeployStatus struct {
+	Running  bool
+	Trigger  string
+	Started  time.Time
+	Finished time.Time
+	Commit   Revision
+	Error    string
+	Errors   []string
+	Warnings []string
+}
+
+// deployer runs one deploy at a time. Webhooks arriving during a deploy
+// queue a single one more, which picks up everything pushed meanwhile.
+type deployer struct {
+	sync.Mutex
+	status  DeployStatus
+	pending bool
+}
+
+var deploys deployer
+
+// Trigger starts a deploy, or queues one if a deploy is running.
+func (d *deployer) Trigger(trigger string) {
+	d.Lock()
+	defer d.Unlock()
+	if d.status.Running {
+		d.pending = true
+		return
+	}
+	d.status.Running = true
+	go d.run(trigger)
+}
+
+func (d *deployer) run(trigger string) {
+	for {
+		status := deploySite(trigger)
+
+		d.Lock()
+		status.Running = d.pending
+		d.status = status
+		if !d.pending {
+			d.Unlock()
+			return
+		}
+		d.pending = false
+		d.Unlock()
+	}
+}
+
+// Status returns the state of the last or running deploy.
+func (d *deployer) Status() DeployStatus {
+	d.Lock()
+	defer d.Unlock()
+	return d.status
+}
+
+// deploySite fetches the deployed branch, checks it out and reloads the
+// templates and translations, rebuilding the static site with git.build.
+// Pages and entries are read from the content directory on every request,
+// so they are live once checked out. Only the checkout and reload keep
+// requests waiting; the fetch and the build run alongside them.
+func deploySite(trigger string) DeployStatus {
+	status := DeployStatus{Trigger: trigger, Started: time.Now()}
+	log.Println("Deploying content, triggered by", trigger)
+
+	fail := func(msg string, err error) DeployStatus {
+		log.Println("Error "+msg+":", err)
+		status.Error = "Error " + msg + ": " + err.Error()
+		status.Finished = time.Now()
+		return status
+	}
+
+	hash, err := contentRepo.Fetch()
+	if err != nil {
+		return fail("fetching content", err)
+	}
+
+	siteMu.Lock()
+	commit, err := contentRepo.Checkout(hash)
+	if err == nil {
+		status.Errors, status.Warnings = report.Collect(func() {
+			loadTranslations()
+			loadTemplates()
+		})
+	}
+	siteMu.Unlock()
+	if err != nil {
+		return fail("checking out content", err)
+	}
+	status.Commit = commit
+
+	if cfg.Git.Build {
+		errs, warnings, err := rebuildSite()
+		status.Errors = append(status.Errors, errs...)
+		status.Warnings = append(status.Warnings, warnings...)
+		if err != nil {
+			return fail("building site", err)
+		}
+	}
+
+	status.Finished = time.Now()
+	log.Printf("Deployed %s with %d error(s) and %d warning(s)", commit.Short(), len(status.Errors), len(status.Warnings))
+	return status
+}
+
+// rebuildSite builds the static site into -out by running pubgo in build
+// mode, which stages the site and swaps it into place, and returns the
+// errors and warnings of the summary it writes. The build runs in a
+// process of its own as pages render differently while serving.
+func rebuildSite() (errors, warnings []string, err error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, nil, err
+	}
+	summary, err := os.CreateTemp("", "pubgo-summary-*.json")
+	if err != nil {
+		return nil, nil, err
+	}
+	summary.Close()
+	defer os.Remove(summary.Name())
+
+	args := []string{"-mode", "build", "-config", configFile, "-content_dir", cfg.ContentDir, "-out", cfg.OutputDir, "-summary", summary.Name()}
+	if cfg.Strict {
+		args = append(args, "-strict")
+	}
+	if cfg.Clean {
+		args = append(args, "-clean")
+	}
+
+	cmd := exec.Command(exe, args...)
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	log.Println("Building site into", cfg.OutputDir)
+	runErr := cmd.Run()
+
+	var result buildSummary
+	data, err := os.ReadFile(summary.Name())
+	if err == nil {
+		err = json.Unmarshal(data, &result)
+	}
+	if err != nil || runErr != nil && len(result.Errors) == 0 {
+		// the build didn't get to its summary, e.g. it panicked
+		log.Printf("Build output:\n%s", output.Bytes())
+		if runErr == nil {
+			runErr = fmt.Errorf("reading build summary: %w", err)
+		}
+		return result.Errors, result.Warnings, runErr
+	}
+	return result.Errors, result.Warnings, nil
+}
+
+// Fetch fetches the deployed branch from the origin remote and returns the
+// commit it is at. The content directory must be able to fast forward to
+// it: changes made on the server aren't committed but have to be pushed to
+// the remote.
+func (c *contentRepository) Fetch() (plumbing.Hash, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	err := c.setupRemote()
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	branch, err := c.branch()
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+
+	// go-git fails to update remote branches git packed into packed-refs,
+	// as clones have them, so write the deployed one out on its own
+	tracking := plumbing.NewRemoteReferenceName(git.DefaultRemoteName, branch.Short())
+	if ref, err := c.repo.Reference(tracking, false); err == nil {
+		err = c.repo.Storer.SetReference(ref)
+		if err != nil {
+			return plumbing.ZeroHash, err
+		}
+	}
+
+	err = c.repo.Fetch(&git.FetchOptions{
+		RemoteName: git.DefaultRemoteName,
+		RefSpecs:   []gitconfig.RefSpec{gitconfig.RefSpec("+" + branch.String() + ":" + tracking.String())},
+	})
+	if err != nil && err != git.NoErrAlreadyUpToDate {
+		return plumbing.ZeroHash, err
+	}
+	ref, err := c.repo.Reference(tracking, true)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+
+	ahead := fmt.Errorf("the content directory has changes that aren't on %s/%s, push them there first", git.DefaultRemoteName, branch.Short())
+	wt, err := c.repo.Worktree()
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	status, err := wt.Status()
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	for file, s := range status {
+		if !unversioned(file) && s.Worktree != git.Untracked && (s.Worktree != git.Unmodified || s.Staging != git.Unmodified) {
+			return plumbing.ZeroHash, ahead
+		}
+	}
+
+	head, err := c.repo.Head()
+	if err == plumbing.ErrReferenceNotFound {
+		return ref.Hash(), nil
+	}
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	if head.Hash() == ref.Hash() {
+		return ref.Hash(), nil
+	}
+	current, err := c.repo.CommitObject(head.Hash())
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	fetched, err := c.repo.CommitObject(ref.Hash())
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	ok, err := current.IsAncestor(fetched)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	if !ok {
+		return plumbing.ZeroHash, ahead
+	}
+	return ref.Hash(), nil
+}
+
+// Checkout fast forwards the deployed branch and the content directory to
+// the commit Fetch returned.
+func (c *contentRepository) Checkout(hash plumbing.Hash) (Revision, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	branch, err := c.branch()
+	if err != nil {
+		return Revision{}, err
+	}
+	head, err := c.repo.Reference(plumbing.HEAD, false)
+	if err != nil {
+		return Revision{}, err
+	}
+	if head.Target() != branch {
+		err = c.repo.Storer.SetReference(plumbing.NewSymbolicReference(plumbing.HEAD, branch))
+		if err != nil {
+			return Revision{}, err
+		}
+	}
+
+	wt, err := c.repo.Worktree()
+	if err != nil {
+		return Revision{}, err
+	}
+	err = wt.Reset(&git.ResetOptions{Commit: hash, Mode: git.MergeReset})
+	if err != nil {
+		return Revision{}, err
+	}
+
+	commit, err := c.repo.CommitObject(hash)
+	if err != nil {
+		return Revision{}, err
+	}
+	return Revision{
+		Hash:    commit.Hash.String(),
+		Author:  commit.Author.Name,
+		Date:    commit.Author.When,
+		Message: strings.TrimSpace(commit.Message),
+	}, nil
+}
+
+// setupRemote adds git.remote as the origin remote unless the content
+// directory was cloned from one.
+func (c *contentRepository) setupRemote() error {
+	_, err := c.repo.Remote(git.DefaultRemoteName)
+	if err == nil {
+		return nil
+	}
+	if err != git.ErrRemoteNotFound {
+		return err
+	}
+	if cfg.Git.Remote == "" {
+		return errors.New("set git.remote to the repository to deploy from")
+	}
+	_, err = c.repo.CreateRemote(&gitconfig.RemoteConfig{
+		Name: git.DefaultRemoteName,
+		URLs: []string{cfg.Git.Remote},
+	})
+	return err
+}
+
+// branch returns the deployed branch, git.branch or the one checked out.
+func (c *contentRepository) branch() (plumbing.ReferenceName, error) {
+	if cfg.Git.Branch != "" {
+		return plumbing.NewBranchReferenceName(cfg.Git.Branch), nil
+	}
+	head, err := c.repo.Reference(plumbing.HEAD, false)
+	if err != nil {
+		return "", err
+	}
+	if head.Type() != plumbing.SymbolicReference || !head.Target().IsBranch() {
+		return "", errors.New("the content directory has no branch checked out, set git.branch")
+	}
+	return head.Target(), nil
+}
+
+// Branch returns the deployed branch.
+func (c *contentRepository) Branch() (plumbing.ReferenceName, error) {
+	c.Lock()
+	defer c.Unlock()
+	return c.branch()
+}
+
+// validHookSignature checks the HMAC-SHA256 signature of a webhook body,
+// sent by GitHub as X-Hub-Signature-256 and by Gitea and Gogs as
+// X-Gitea-Signature or X-Gogs-Signature.
+func validHookSignature(h http.Header, body []byte) bool {
+	signature := strings.TrimPrefix(h.Get("X-Hub-Signature-256"), "sha256=")
+	if signature == "" {
+		signature = h.Get("X-Gitea-Signature")
+	}
+	if signature == "" {
+		signature = h.Get("X-Gogs-Signature")
+	}
+	sent, err := hex.DecodeString(signature)
+	if err != nil || len(sent) == 0 {
+		return false
+	}
+
+	mac := hmac.New(sha256.New, []byte(cfg.Git.WebhookSecret))
+	mac.Write(body)
+	return hmac.Equal(sent, mac.Sum(nil))
+}
+
+// hookEvent returns the event a webhook was sent for.
+func hookEvent(h http.Header) string {
+	for _, name := range []string{"X-GitHub-Event", "X-Gitea-Event", "X-Gogs-Event"} {
+		if event := h.Get(name); event != "" {
+			return event
+		}
+	}
+	return ""
+}
+
+// hookRef returns the ref a push webhook was sent for. GitHub may post the
+// payload as a form.
+func hookRef(r *http.Request, body []byte) (string, error) {
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/x-www-form-urlencoded") {
+		form, err := url.ParseQuery(string(body))
+		if err != nil {
+			return "", err
+		}
+		body = []byte(form.Get("payload"))
+	}
+
+	var payload struct {
+		Ref string `json:"ref"`
+	}
+	err := json.Unmarshal(body, &payload)
+	return payload.Ref, err
+}
+
+// deployHook deploys the content when a signed push webhook arrives for the
+// deployed branch.
+func deployHook(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 1<<20))
+	if err != nil {
+		http.Error(w, "Payload too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	if !validHookSignature(r.Header, body) {
+		log.Println("Webhook with invalid signature from", clientIP(r))
+		http.Error(w, "Invalid signature", http.StatusUnauthorized)
+		return
+	}
+
+	switch hookEvent(r.Header) {
+	case "ping":
+		fmt.Fprintln(w, "pong")
+		return
+	case "push", "":
+	default:
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	ref, err := hookRef(r, body)
+	if err != nil {
+		http.Error(w, "Invalid payload", http.StatusBadRequest)
+		return
+	}
+	branch, err := contentRepo.Branch()
+	if err != nil {
+		log.Println("Error finding branch to deploy:", err)
+		http.Error(w, "Error finding branch to deploy", http.StatusInternalServerError)
+		return
+	}
+	if ref != "" && ref != branch.String() {
+		fmt.Fprintln(w, "Ignoring push to", ref)
+		return
+	}
+
+	deploys.Trigger("webhook")
+	w.WriteHeader(http.StatusAccepted)
+	fmt.Fprintln(w, "Deploying", branch.Short())
+}
+
+// deployEnabled reports whether pushes are deployed by webhook.
+func deployEnabled() bool {
+	return contentRepo != nil && cfg.Git.WebhookSecret != ""
+}
+
+// deployPage is the data of the deployStatusHTML template.
+type deployPage struct {
+	CSRF   string
+	Status DeployStatus
+}
+
+// setupDeployRoutes registers the deploy webhook and the admin's deploy
+// status.
+func setupDeployRoutes() {
+	if cfg.Git.WebhookSecret != "" && !cfg.Git.Enabled {
+		report.Error("git.webhook_secret needs git.enabled")
+	}
+
+	http.HandleFunc("/hooks/deploy", func(w http.ResponseWriter, r *http.Request) {
+		logRequest(r)
+		if !deployEnabled() {
+			http.NotFound(w, r)
+			return
+		}
+		deployHook(w, r)
+	})
+
+	http.HandleFunc("/admin/deploy", func(w http.ResponseWriter, r *http.Request) {
+		logRequest(r)
+		user, sess, ok := adminAuthorized(w, r, "deploy")
+		if !ok {
+			return
+		}
+		if !deployEnabled() {
+			http.NotFound(w, r)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPost:
+			deploys.Trigger(user.Name)
+			audit(r, user.Name, "deploy", "")
+		default:
+			w.Header().Set("Allow", "GET, POST")
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		page := deployPage{CSRF: csrfToken(sess.ID, "admin"), Status: deploys.Status()}
+		executeTemplate(w, 0, "deployStatusHTML", page)
+	})
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"pubgo/config"
+)
+
+// gitRun runs git in dir and returns its trimmed output.
+func gitRun(t *testing.T, dir string, args ...string) string {
+	t.Helper()
+	args = append([]string{"-c", "user.name=Ann", "-c", "user.email=ann@example.com", "-c", "init.defaultBranch=main"}, args...)
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("git %s: %v\n%s", strings.Join(args, " "), err, out)
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// signedHook returns a push webhook for ref signed with secret the way
+// GitHub signs them.
+func signedHook(secret, ref string) *http.Request {
+	body := `{"ref": "` + ref + `"}`
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(body))
+
+	r := httptest.NewRequest(http.MethodPost, "/hooks/deploy", strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set("X-GitHub-Event", "push")
+	r.Header.Set("X-Hub-Signature-256", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	return r
+}
+
+func TestDeployHook(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("deploying from a file:// remote needs git")
+	}
+
+	// a bare repository as the remote, a clone of it as the content
+	// directory and another one to push from
+	dir := t.TempDir()
+	remote := filepath.Join(dir, "site.git")
+	src := filepath.Join(dir, "src")
+	site := filepath.Join(dir, "site")
+	gitRun(t, dir, "init", "--bare", remote)
+	gitRun(t, dir, "init", src)
+	err := os.WriteFile(filepath.Join(src, "home.md"), []byte("# Home\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gitRun(t, src, "add", "-A")
+	gitRun(t, src, "commit", "-m", "Add home")
+	gitRun(t, src, "push", remote, "main")
+	gitRun(t, dir, "clone", remote, site)
+
+	saved, savedRepo := cfg, contentRepo
+	t.Cleanup(func() { cfg, contentRepo = saved, savedRepo })
+	cfg.Mode = "serve"
+	cfg.ContentDir = site
+	cfg.Git = config.Git{Enabled: true, Branch: "main", WebhookSecret: "secret"}
+	contentRepo, err = openContentRepository()
+	if err != nil {
+		t.Fatal("opening content repository:", err)
+	}
+
+	err = os.WriteFile(filepath.Join(src, "about.md"), []byte("# About\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gitRun(t, src, "add", "-A")
+	gitRun(t, src, "commit", "-m", "Add about")
+	gitRun(t, src, "push", remote, "main")
+	pushed := gitRun(t, src, "rev-parse", "HEAD")
+
+	// unsigned and foreign payloads don't deploy
+	w := httptest.NewRecorder()
+	deployHook(w, signedHook("wrong", "refs/heads/main"))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("wrongly signed hook: status %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+	w = httptest.NewRecorder()
+	deployHook(w, signedHook("secret", "refs/heads/draft"))
+	if w.Code != http.StatusOK {
+		t.Errorf("hook for another branch: status %d, want %d", w.Code, http.StatusOK)
+	}
+
+	w = httptest.NewRecorder()
+	deployHook(w, signedHook("secret", "refs/heads/main"))
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("hook: status %d, want %d: %s", w.Code, http.StatusAccepted, w.Body)
+	}
+
+	var status DeployStatus
+	for deadline := time.Now().Add(30 * time.Second); ; {
+		status = deploys.Status()
+		if !status.Running && !status.Finished.IsZero() {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the deploy didn't finish")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	if status.Error != "" {
+		t.Fatal("deploy failed:", status.Error)
+	}
+	if status.Trigger != "webhook" {
+		t.Errorf("trigger = %q, want webhook", status.Trigger)
+	}
+	if status.Commit.Hash != pushed || status.Commit.Message != "Add about" {
+		t.Errorf("deployed %s %q, want %s %q", status.Commit.Hash, status.Commit.Message, pushed, "Add about")
+	}
+	if head := gitRun(t, site, "rev-parse", "HEAD"); head != pushed {
+		t.Errorf("content directory at %s, want %s", head, pushed)
+	}
+	if _, err := os.Stat(filepath.Join(site, "about.md")); err != nil {
+		t.Error("pushed file missing from the content directory:", err)
+	}
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"io/fs"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// editorSkipDirs are the directories of the content directory that don't
+// hold pages or entries.
+var editorSkipDirs = map[string]bool{
+	"comments":  true,
+	"forms":     true,
+	"static":    true,
+	"templates": true,
+	"themes":    true,
+	"i18n":      true,
+}
+
+// editorPage is the data of the adminContentHTML and adminEditHTML
+// templates.
+type editorPage struct {
+	adminPage
+	Files   []string
+	Path    string
+	Body    string
+	History []Revision
+	Git     bool
+	// Deployed is set when the content is deployed from git and can't be
+	// edited here.
+	Deployed bool
+	Message  string
+}
+
+// contentFile checks a content file path given to the editor, relative to
+// the content directory with forward slashes, and returns it cleaned.
+func contentFile(rel string) (string, bool) {
+	if rel == "" || strings.Contains(rel, "\\") {
+		return "", false
+	}
+	clean := path.Clean(rel)
+	if path.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, "../") || path.Ext(clean) != ".md" {
+		return "", false
+	}
+	first := strings.SplitN(clean, "/", 2)[0]
+	if editorSkipDirs[first] || strings.HasPrefix(first, ".") {
+		return "", false
+	}
+	return clean, true
+}
+
+// contentFiles lists the pages and entries in the content directory.
+func contentFiles() ([]string, error) {
+	var files []string
+	err := filepath.WalkDir(cfg.ContentDir, func(file string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(cfg.ContentDir, file)
+		rel = filepath.ToSlash(rel)
+		if d.IsDir() {
+			if rel != "." && (editorSkipDirs[rel] || strings.HasPrefix(d.Name(), ".")) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if _, ok := contentFile(rel); ok {
+			files = append(files, rel)
+		}
+		return nil
+	})
+	sort.Strings(files)
+	return files, err
+}
+
+func newEditorPage(r *http.Request, user User, sess session, rel string) editorPage {
+	page := editorPage{
+		adminPage: adminPage{
+			Content: adminContent(r, "Content"),
+			User:    user,
+			CSRF:    csrfToken(sess.ID, "admin"),
+		},
+		Path:     rel,
+		Git:      contentRepo != nil,
+		Deployed: deployEnabled(),
+	}
+	if rel == "" {
+		return page
+	}
+
+	data, err := os.ReadFile(filepath.Join(cfg.ContentDir, filepath.FromSlash(rel)))
+	if err != nil && !os.IsNotExist(err) {
+		log.Println("Error reading content file:", err)
+		page.Error = err.Error()
+	}
+	page.Body = string(data)
+
+	if contentRepo != nil {
+		page.History, err = contentRepo.History(rel)
+		if err != nil {
+			log.Println("Error loading history:", err)
+			page.Error = "Error loading history: " + err.Error()
+		}
+	}
+	return page
+}
+
+// renderContentList lists the content files to edit.
+func renderContentList(w http.ResponseWriter, r *http.Request, user User, sess session) {
+	page := newEditorPage(r, user, sess, "")
+	var err error
+	page.Files, err = contentFiles()
+	if err != nil {
+		log.Println("Error listing content:", err)
+		page.Error = err.Error()
+	}
+	executeTemplate(w, 0, "adminContentHTML", page)
+}
+
+// deployedContentMessage refuses edits to content deployed from git.
+const deployedContentMessage = "The content is deployed from git, change it in the repository and push"
+
+// saveContent writes a content file posted from the editor and commits it
+// as the user when git is enabled.
+func saveContent(w http.ResponseWriter, r *http.Request, user User, rel string) {
+	if deployEnabled() {
+		http.Error(w, deployedContentMessage, http.StatusConflict)
+		return
+	}
+	body := strings.ReplaceAll(r.PostFormValue("body"), "\r\n", "\n")
+	file := filepath.Join(cfg.ContentDir, filepath.FromSlash(rel))
+	write := func() error {
+		err := os.MkdirAll(filepath.Dir(file), 0755)
+		if err != nil {
+			return err
+		}
+		return os.WriteFile(file, []byte(body), 0644)
+	}
+
+	var err error
+	if contentRepo != nil {
+		err = contentRepo.Edit(rel, user, "Edit "+rel, write)
+	} else {
+		err = write()
+	}
+	if err != nil {
+		log.Println("Error saving", rel+":", err)
+		http.Error(w, "Error saving "+rel, http.StatusInternalServerError)
+		return
+	}
+
+	log.Println(rel, "edited by", user.Name)
+	audit(r, user.Name, "content edit", rel)
+	http.Redirect(w, r, "/admin/content/edit?saved=1&path="+url.QueryEscape(rel), http.StatusSeeOther)
+}
+
+// revertContent restores a content file to an earlier revision.
+func revertContent(w http.ResponseWriter, r *http.Request, user User, rel string) {
+	if contentRepo == nil {
+		http.NotFound(w, r)
+		return
+	}
+	if deployEnabled() {
+		http.Error(w, deployedContentMessage, http.StatusConflict)
+		return
+	}
+	rev := r.PostFormValue("rev")
+	if !validRevision(rev) {
+		http.Error(w, "Unknown revision", http.StatusBadRequest)
+		return
+	}
+	err := contentRepo.Revert(rel, rev, user)
+	if err != nil {
+		log.Println("Error reverting", rel+":", err)
+		http.Error(w, "Error reverting "+rel, http.StatusInternalServerError)
+		return
+	}
+
+	short := Revision{Hash: rev}.Short()
+	log.Println(rel, "reverted to", short, "by", user.Name)
+	audit(r, user.Name, "content revert", rel+"@"+short)
+	http.Redirect(w, r, "/admin/content/edit?saved=1&path="+url.QueryEscape(rel), http.StatusSeeOther)
+}
+
+// setupEditorRoutes registers the handlers of the content editor.
+func setupEditorRoutes() {
+	http.HandleFunc("/admin/content", func(w http.ResponseWriter, r *http.Request) {
+		logRequest(r)
+		user, sess, ok := adminAuthorized(w, r, "edit")
+		if !ok {
+			return
+		}
+		renderContentList(w, r, user, sess)
+	})
+
+	http.HandleFunc("/admin/content/edit", func(w http.ResponseWriter, r *http.Request) {
+		logRequest(r)
+		user, sess, ok := adminAuthorized(w, r, "edit")
+		if !ok {
+			return
+		}
+		rel, ok := contentFile(r.FormValue("path"))
+		if !ok {
+			http.Error(w, "Not a content file", http.StatusBadRequest)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			page := newEditorPage(r, user, sess, rel)
+			if r.FormValue("saved") != "" {
+				page.Message = "Saved " + rel
+			}
+			executeTemplate(w, 0, "adminEditHTML", page)
+		case http.MethodPost:
+			saveContent(w, r, user, rel)
+		default:
+			w.Header().Set("Allow", "GET, POST")
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+
+	http.HandleFunc("/admin/content/diff", func(w http.ResponseWriter, r *http.Request) {
+		logRequest(r)
+		if _, _, ok := adminAuthorized(w, r, "edit"); !ok {
+			return
+		}
+		rel, ok := contentFile(r.FormValue("path"))
+		if !ok || contentRepo == nil {
+			http.NotFound(w, r)
+			return
+		}
+		if !validRevision(r.FormValue("rev")) {
+			http.Error(w, "Unknown revision", http.StatusBadRequest)
+			return
+		}
+		diff, err := contentRepo.Diff(rel, r.FormValue("rev"))
+		if err != nil {
+			log.Println("Error loading diff:", err)
+			http.Error(w, "Error loading diff", http.StatusInternalServerError)
+			return
+		}
+		executeTemplate(w, 0, "contentDiffHTML", diff)
+	})
+
+	http.HandleFunc("/admin/content/revert", func(w http.ResponseWriter, r *http.Request) {
+		logRequest(r)
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		user, _, ok := adminAuthorized(w, r, "revert")
+		if !ok {
+			return
+		}
+		rel, ok := contentFile(r.PostFormValue("path"))
+		if !ok {
+			http.Error(w, "Not a content file", http.StatusBadRequest)
+			return
+		}
+		revertContent(w, r, user, rel)
+	})
+}
@@ -1,17 +1,20 @@
 package main
 
 import (
+	"errors"
+	"fmt"
+	"io/fs"
 	"log"
 	"os"
 	"path/filepath"
 	"pubgo/config"
-	"strings"
+	"time"
 )
 
 func primeDirectory(dir string) {
 	// If directory doesn't exist, create it
 	if _, err := os.Stat(dir); os.IsNotExist(err) {
-		err = os.Mkdir(dir, 0755)
+		err = os.MkdirAll(dir, 0755)
 		if err != nil {
 			log.Println("Error creating content directory:", err)
 			panic(err)
@@ -34,42 +37,146 @@ func primePageEntry(page config.Page) {
 	}
 }
 
-// walkAndCopyFiles copies files from src to dest directory
-func walkAndCopyFiles(src string, dest string) error {
-	err := filepath.Walk(filepath.Join(src, "static"), func(path string, info os.FileInfo, err error) error {
-		// sanitize content dir
-		contentDir := strings.TrimPrefix(src, "./")
+// walkAndCopyFiles copies the static directory of src to the dest
+// directory. Files that can't be copied are reported and skipped.
+func walkAndCopyFiles(src string, dest string) {
+	static := filepath.Join(src, "static")
+	filepath.Walk(static, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if path != static || !os.IsNotExist(err) {
+				report.Error("Error reading static file:", err)
+			}
+			return nil
+		}
 
-		// path removing content dir
-		newPath := strings.Replace(path, contentDir, dest, 1)
-		log.Printf("path: %s\n", path)
-		log.Printf("newPath: %s\n", newPath)
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			report.Error("Error copying static file:", err)
+			return nil
+		}
+		newPath := filepath.Join(dest, rel)
 
 		if info.IsDir() {
-			// create directory in outputdir/static if it doesn't exist
-			if info.Name() != "static" {
-				err := os.MkdirAll(newPath, 0755)
-				if err != nil {
-					log.Println("Error creating static directory:", err)
-					return err
-				}
-			}
-		} else {
-			data, err := os.ReadFile(path)
+			err = os.MkdirAll(newPath, 0755)
 			if err != nil {
-				log.Println("Error reading file:", err)
-				return err
-			}
-
-			err = os.WriteFile(newPath, data, 0644)
-			if err != nil {
-				log.Println("Error writing file:", err)
-				return err
+				report.Error("Error creating static directory:", err)
+				return filepath.SkipDir
 			}
+			return nil
 		}
 
+		data, err := os.ReadFile(path)
+		if err != nil {
+			report.Error("Error reading static file:", err)
+			return nil
+		}
+		err = os.WriteFile(newPath, data, 0644)
+		if err != nil {
+			report.Error("Error writing static file:", err)
+		}
 		return nil
 	})
+}
+
+// copyFS copies every file in fsys to the dest directory.
+func copyFS(fsys fs.FS, dest string) error {
+	return fs.WalkDir(fsys, ".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
 
-	return err
+		newPath := filepath.Join(dest, path)
+		if d.IsDir() {
+			return os.MkdirAll(newPath, 0755)
+		}
+
+		data, err := fs.ReadFile(fsys, path)
+		if err != nil {
+			return err
+		}
+		return os.WriteFile(newPath, data, 0644)
+	})
+}
+
+// staleBuildAge is how long a build directory goes unchanged before it is
+// taken to be left behind by an interrupted build rather than one still
+// running.
+const staleBuildAge = time.Hour
+
+// stageOutputDir creates the directory a build of out is written to, next
+// to out so it can be renamed into place. Unless clean is set it starts as
+// a copy of out, keeping the files the build doesn't produce. Directories
+// left behind by interrupted builds are removed.
+func stageOutputDir(out string, clean bool) (string, error) {
+	parent, base := filepath.Dir(out), filepath.Base(out)
+	if base == "." || base == string(filepath.Separator) {
+		return "", fmt.Errorf("can't build into %s, choose another output directory", out)
+	}
+	primeDirectory(parent)
+
+	leftovers, _ := filepath.Glob(filepath.Join(parent, "."+base+"-build-*"))
+	for _, dir := range leftovers {
+		info, err := os.Stat(dir)
+		if err != nil || time.Since(info.ModTime()) < staleBuildAge {
+			continue
+		}
+		log.Println("Removing unfinished build", dir)
+		os.RemoveAll(dir)
+	}
+
+	staging, err := os.MkdirTemp(parent, "."+base+"-build-")
+	if err != nil {
+		return "", err
+	}
+	// MkdirTemp makes it private, the site isn't
+	err = os.Chmod(staging, 0755)
+	if err == nil && !clean && isDir(out) {
+		err = copyFS(os.DirFS(out), staging)
+	}
+	if err != nil {
+		os.RemoveAll(staging)
+		return "", err
+	}
+	return staging, nil
+}
+
+// errNoExchange is returned by exchangeDirectories on systems that can't
+// swap two directories at once.
+var errNoExchange = errors.New("exchanging directories isn't supported")
+
+// swapDirectory replaces dir with staging. The two are exchanged at once
+// where the system supports it. Elsewhere a directory can't be renamed over
+// another, so the old one is moved aside first, leaving a moment without
+// dir, and removed after.
+func swapDirectory(staging, dir string) error {
+	if _, err := os.Lstat(dir); os.IsNotExist(err) {
+		return os.Rename(staging, dir)
+	}
+	err := exchangeDirectories(staging, dir)
+	if err == nil {
+		// staging now holds the previous site
+		return os.RemoveAll(staging)
+	}
+	if err != errNoExchange {
+		return err
+	}
+
+	old := staging + "-old"
+	err = os.Rename(dir, old)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	moved := err == nil
+
+	err = os.Rename(staging, dir)
+	if err != nil {
+		if moved {
+			os.Rename(old, dir)
+		}
+		return err
+	}
+	if moved {
+		return os.RemoveAll(old)
+	}
+	return nil
 }
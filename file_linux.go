@@ -0,0 +1,23 @@
+//go:build linux
+
+package main
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// exchangeDirectories swaps a and b in a single rename, so there is no
+// moment either of them is missing.
+func exchangeDirectories(a, b string) error {
+	err := unix.Renameat2(unix.AT_FDCWD, a, unix.AT_FDCWD, b, unix.RENAME_EXCHANGE)
+	// kernels before 3.15 and some file systems can't exchange
+	if err == unix.ENOSYS || err == unix.EINVAL {
+		return errNoExchange
+	}
+	if err != nil {
+		return &os.LinkError{Op: "exchange", Old: a, New: b, Err: err}
+	}
+	return nil
+}
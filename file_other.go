@@ -0,0 +1,9 @@
+//go:build !linux
+
+package main
+
+// exchangeDirectories swaps a and b in a single rename where the system
+// supports it.
+func exchangeDirectories(a, b string) error {
+	return errNoExchange
+}
@@ -0,0 +1,520 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"pubgo/config"
+	"pubgo/content"
+)
+
+// formHoneypot is the form field hidden from visitors. Submissions filling
+// it in come from bots and are dropped.
+const formHoneypot = "fax_number"
+
+var (
+	formLimiter *rateLimiter
+	// formPatterns holds the compiled patterns of the form fields, keyed by
+	// form and field name.
+	formPatterns = make(map[string]*regexp.Regexp)
+	formTypes    = map[string]bool{
+		"text": true, "textarea": true, "email": true, "url": true,
+		"tel": true, "number": true, "checkbox": true, "select": true,
+	}
+)
+
+// FormValue is a submitted form field.
+type FormValue struct {
+	Name  string `json:"name"`
+	Label string `json:"label"`
+	Value string `json:"value"`
+}
+
+// FormSubmission is a stored form submission.
+type FormSubmission struct {
+	ID     string      `json:"id"`
+	Form   string      `json:"form"`
+	Date   time.Time   `json:"date"`
+	Values []FormValue `json:"values"`
+	// Errors lists the deliveries that failed.
+	Errors []string `json:"errors,omitempty"`
+}
+
+// formDelivery sends form submissions on, e.g. by email.
+type formDelivery interface {
+	Deliver(form config.Form, sub FormSubmission) error
+}
+
+// formDeliveries returns where submissions of form are delivered to.
+func formDeliveries(form config.Form) []formDelivery {
+	var list []formDelivery
+	if len(form.To) > 0 {
+		list = append(list, smtpDelivery{})
+	}
+	if form.Webhook != "" {
+		list = append(list, webhookDelivery{})
+	}
+	return list
+}
+
+// smtpDelivery mails submissions to the form's recipients.
+type smtpDelivery struct {
+	// Addr is the host:port of the mail server, smtp.host and smtp.port
+	// unless set.
+	Addr string
+}
+
+func (d smtpDelivery) Deliver(form config.Form, sub FormSubmission) error {
+	s := cfg.SMTP
+	addr := d.Addr
+	if addr == "" {
+		if s.Host == "" {
+			return fmt.Errorf("no smtp host configured")
+		}
+		port := s.Port
+		if port == 0 {
+			port = 25
+		}
+		addr = net.JoinHostPort(s.Host, strconv.Itoa(port))
+	}
+	from := s.From
+	if from == "" {
+		from = s.Username
+	}
+
+	subject := form.Subject
+	if subject == "" {
+		subject = "New " + sub.Form + " submission"
+	}
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", from)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(form.To, ", "))
+	fmt.Fprintf(&msg, "Subject: [%s] %s\r\n", cfg.Site.Name, subject)
+	fmt.Fprintf(&msg, "Date: %s\r\n", sub.Date.Format(time.RFC1123Z))
+	for _, v := range sub.Values {
+		// replies go to the first email given in the form, validated so it
+		// can't add headers of its own
+		if f, ok := formField(form, v.Name); ok && f.Type == "email" && v.Value != "" {
+			fmt.Fprintf(&msg, "Reply-To: %s\r\n", v.Value)
+			break
+		}
+	}
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	for _, v := range sub.Values {
+		fmt.Fprintf(&msg, "%s:\r\n%s\r\n\r\n", v.Label, strings.ReplaceAll(v.Value, "\n", "\r\n"))
+	}
+
+	return sendMail(s, addr, from, form.To, msg.Bytes())
+}
+
+// sendMail works like smtp.SendMail, with timeouts so a stuck mail server
+// doesn't hold up the response.
+func sendMail(s config.SMTP, addr string, from string, to []string, msg []byte) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	conn, err := net.DialTimeout("tcp", addr, 10*time.Second)
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		err = c.StartTLS(&tls.Config{ServerName: host})
+		if err != nil {
+			return err
+		}
+	}
+	if s.Username != "" {
+		err = c.Auth(smtp.PlainAuth("", s.Username, s.Password, host))
+		if err != nil {
+			return err
+		}
+	}
+
+	err = c.Mail(from)
+	if err != nil {
+		return err
+	}
+	for _, addr := range to {
+		err = c.Rcpt(addr)
+		if err != nil {
+			return err
+		}
+	}
+
+	wc, err := c.Data()
+	if err != nil {
+		return err
+	}
+	_, err = wc.Write(msg)
+	if err != nil {
+		return err
+	}
+	err = wc.Close()
+	if err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// webhookDelivery posts submissions as JSON to the form's webhook.
+type webhookDelivery struct{}
+
+func (webhookDelivery) Deliver(form config.Form, sub FormSubmission) error {
+	data, err := json.Marshal(sub)
+	if err != nil {
+		return err
+	}
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Post(form.Webhook, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// checkForms validates the configured forms and compiles their patterns.
+func checkForms() {
+	for name, form := range cfg.Forms {
+		seen := make(map[string]bool)
+		for _, f := range form.Fields {
+			switch {
+			case f.Name == "":
+				report.Error("Form", name, "has a field without a name")
+			case f.Name == formHoneypot || f.Name == csrfField:
+				report.Error("Form", name, "can't have a field named", f.Name)
+			case seen[f.Name]:
+				report.Error("Form", name, "has more than one field named", f.Name)
+			case f.Type != "" && !formTypes[f.Type]:
+				report.Error("Form", name, "field", f.Name, "has unknown type", f.Type)
+			case f.Type == "select" && len(f.Options) == 0:
+				report.Error("Form", name, "field", f.Name, "needs options")
+			}
+			seen[f.Name] = true
+
+			if f.Pattern != "" {
+				re, err := regexp.Compile("^(?:" + f.Pattern + ")$")
+				if err != nil {
+					report.Error("Form", name, "field", f.Name, "has an invalid pattern:", err)
+					continue
+				}
+				formPatterns[name+"/"+f.Name] = re
+			}
+		}
+	}
+}
+
+func formField(form config.Form, name string) (config.FormField, bool) {
+	for _, f := range form.Fields {
+		if f.Name == name {
+			return f, true
+		}
+	}
+	return config.FormField{}, false
+}
+
+// validateFormField checks a submitted value, returning what is wrong
+// with it.
+func validateFormField(formName string, f config.FormField, value string) string {
+	if value == "" {
+		if f.Required {
+			return "This field is required."
+		}
+		return ""
+	}
+
+	max := f.MaxLength
+	if max == 0 {
+		max = 200
+		if f.Type == "textarea" {
+			max = 5000
+		}
+	}
+	if utf8.RuneCountInString(value) > max {
+		return fmt.Sprintf("Please use at most %d characters.", max)
+	}
+
+	switch f.Type {
+	case "email":
+		addr, err := mail.ParseAddress(value)
+		if err != nil || addr.Name != "" {
+			return "Please enter a valid email address."
+		}
+	case "url":
+		u, err := url.ParseRequestURI(value)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return "Please enter a valid URL."
+		}
+	case "number":
+		if _, err := strconv.ParseFloat(value, 64); err != nil {
+			return "Please enter a number."
+		}
+	case "select":
+		valid := false
+		for _, o := range f.Options {
+			valid = valid || o == value
+		}
+		if !valid {
+			return "Please choose one of the options."
+		}
+	}
+
+	if re, ok := formPatterns[formName+"/"+f.Name]; ok && !re.MatchString(value) {
+		return "Please match the requested format."
+	}
+	return ""
+}
+
+// storeFormSubmission writes a submission to <content_dir>/forms/<form>.
+func storeFormSubmission(sub FormSubmission) error {
+	dir := filepath.Join(cfg.ContentDir, "forms", sub.Form)
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(sub, "", "  ")
+	if err != nil {
+		return err
+	}
+	file := filepath.Join(dir, sub.Date.Format("20060102-150405")+"-"+sub.ID+".json")
+	return os.WriteFile(file, data, 0600)
+}
+
+// formView is the data of the formHTML template.
+type formView struct {
+	Name    string
+	Title   string
+	Submit  string
+	Token   string
+	Fields  []formFieldView
+	Sent    bool
+	Message string
+	Error   string
+}
+
+type formFieldView struct {
+	config.FormField
+	Value string
+	Error string
+}
+
+func newFormView(name string, form config.Form, token string) formView {
+	view := formView{
+		Name:   name,
+		Title:  form.Title,
+		Submit: form.Submit,
+		Token:  token,
+	}
+	for _, f := range form.Fields {
+		if f.Type == "" {
+			f.Type = "text"
+		}
+		if f.Label == "" {
+			f.Label = f.Name
+		}
+		view.Fields = append(view.Fields, formFieldView{FormField: f})
+	}
+	return view
+}
+
+// setupFormRoutes registers the handler of the configured forms. GET
+// returns the form, POST takes a submission. The handler isn't behind
+// lockedHandler but takes the site lock itself.
+func setupFormRoutes() {
+	formLimiter = newRateLimiter(cfg.FormRateLimit, 10*time.Minute)
+
+	http.HandleFunc("/forms/", func(w http.ResponseWriter, r *http.Request) {
+		logRequest(r)
+		name := strings.TrimPrefix(r.URL.Path, "/forms/")
+		form, ok := cfg.Forms[name]
+		if !ok {
+			siteMu.RLock()
+			defer siteMu.RUnlock()
+			handleNotFoundError(w, r)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			siteMu.RLock()
+			defer siteMu.RUnlock()
+			view := newFormView(name, form, csrfToken(csrfID(w, r), "/forms/"+name))
+			writeForm(w, r, view)
+		case http.MethodPost:
+			submitForm(w, r, name, form)
+		default:
+			w.Header().Set("Allow", "GET, POST")
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+}
+
+// submitForm validates, stores and delivers a form submission. It holds
+// the site lock itself but not while delivering, so slow mail servers and
+// webhooks don't hold up deploys.
+func submitForm(w http.ResponseWriter, r *http.Request, name string, form config.Form) {
+	siteMu.RLock()
+	view, sub, deliver := readSubmission(w, r, name, form)
+	if !deliver {
+		writeForm(w, r, view)
+		siteMu.RUnlock()
+		return
+	}
+	siteMu.RUnlock()
+
+	for _, d := range formDeliveries(form) {
+		err := d.Deliver(form, sub)
+		if err != nil {
+			log.Println("Error delivering submission of form", name+":", err)
+			sub.Errors = append(sub.Errors, err.Error())
+		}
+	}
+
+	siteMu.RLock()
+	defer siteMu.RUnlock()
+
+	// the submission is kept even when it couldn't be delivered, so
+	// nothing is lost
+	err := storeFormSubmission(sub)
+	if err != nil {
+		log.Println("Error storing submission of form", name+":", err)
+		if len(sub.Errors) > 0 || len(formDeliveries(form)) == 0 {
+			view.Error = i18n("Your message couldn't be sent, please try again later.")
+			writeForm(w, r, view)
+			return
+		}
+	}
+	log.Println("New submission", sub.ID, "of form", name)
+
+	view.Sent = true
+	view.Message = formSuccess(form)
+	writeForm(w, r, view)
+}
+
+// readSubmission checks a posted form and returns the view of it along
+// with the submission, which is only to be delivered if deliver is set.
+// Otherwise the view tells the visitor what went wrong.
+func readSubmission(w http.ResponseWriter, r *http.Request, name string, form config.Form) (view formView, sub FormSubmission, deliver bool) {
+	view = newFormView(name, form, csrfToken(csrfID(w, r), "/forms/"+name))
+
+	if !checkCSRF(r, "/forms/"+name) {
+		view.Error = i18n("Your session expired, please send the form again.")
+		return view, sub, false
+	}
+
+	// bots fill in the field hidden from people, pretend it worked
+	if r.PostFormValue(formHoneypot) != "" {
+		log.Println("Dropped submission of form", name, "from", clientIP(r)+", honeypot filled in")
+		view.Sent = true
+		view.Message = formSuccess(form)
+		return view, sub, false
+	}
+
+	sub = FormSubmission{
+		ID:   randomID(8),
+		Form: name,
+		Date: time.Now(),
+	}
+	valid := true
+	for i, f := range view.Fields {
+		value := strings.TrimSpace(strings.ReplaceAll(r.PostFormValue(f.Name), "\r\n", "\n"))
+		if f.Type == "checkbox" && value != "" {
+			value = "yes"
+		}
+		view.Fields[i].Value = value
+		view.Fields[i].Error = i18n(validateFormField(name, f.FormField, value))
+		if view.Fields[i].Error != "" {
+			valid = false
+		}
+		sub.Values = append(sub.Values, FormValue{Name: f.Name, Label: f.Label, Value: value})
+	}
+	if !valid {
+		view.Error = i18n("Please correct the fields below.")
+		return view, sub, false
+	}
+
+	// only valid submissions count, so correcting a form doesn't use up
+	// the limit
+	if !formLimiter.Allow(clientIP(r)) {
+		view.Error = i18n("Too many submissions, please try again later.")
+		return view, sub, false
+	}
+
+	return view, sub, true
+}
+
+func formSuccess(form config.Form) string {
+	if form.Success != "" {
+		return form.Success
+	}
+	return i18n("Thanks, your message has been sent.")
+}
+
+// writeForm responds with the form. htmx requests get the form alone to
+// swap into the page, others a page showing it so forms work without
+// JavaScript.
+func writeForm(w http.ResponseWriter, r *http.Request, view formView) {
+	if r.Header.Get("HX-Request") == "true" {
+		executeTemplate(w, 0, "formHTML", view)
+		return
+	}
+
+	body, err := executeToHTML("formHTML", view)
+	if err != nil {
+		log.Println("Error executing template:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	title := view.Title
+	if title == "" {
+		title = view.Name
+	}
+	cont := content.Content{
+		Site:        cfg.Site,
+		Page:        config.Page{Lang: defaultLanguage()},
+		RequestPath: r.URL.Path,
+		BasePath:    cfg.BaseURL,
+		Mode:        cfg.Mode,
+		Title:       cfg.Site.Name + " ~ " + title,
+		Entry: content.Entry{
+			Title: title,
+			Body:  template.HTML(body),
+		},
+	}
+	localizeContent(&cont)
+	executeTemplate(w, 0, "indexHTML", cont)
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+
+	"pubgo/config"
+)
+
+// fakeMail is a message received by fakeSMTPServer.
+type fakeMail struct {
+	From string
+	To   []string
+	Data string
+}
+
+// fakeSMTPServer accepts a single SMTP session on a local port and sends
+// the message it receives on the returned channel.
+func fakeSMTPServer(t *testing.T) (string, <-chan fakeMail) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	received := make(chan fakeMail, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+		tp := textproto.NewConn(conn)
+		var mail fakeMail
+		tp.PrintfLine("220 localhost fake ESMTP")
+		for {
+			line, err := tp.ReadLine()
+			if err != nil {
+				return
+			}
+			cmd := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+			switch cmd {
+			case "EHLO", "HELO":
+				tp.PrintfLine("250 localhost")
+			case "MAIL":
+				mail.From = strings.TrimSuffix(strings.TrimPrefix(line, "MAIL FROM:<"), ">")
+				tp.PrintfLine("250 OK")
+			case "RCPT":
+				mail.To = append(mail.To, strings.TrimSuffix(strings.TrimPrefix(line, "RCPT TO:<"), ">"))
+				tp.PrintfLine("250 OK")
+			case "DATA":
+				tp.PrintfLine("354 Go ahead")
+				data, err := tp.ReadDotBytes()
+				if err != nil {
+					return
+				}
+				mail.Data = string(data)
+				tp.PrintfLine("250 OK")
+			case "QUIT":
+				tp.PrintfLine("221 Bye")
+				received <- mail
+				return
+			default:
+				tp.PrintfLine("502 Not implemented")
+			}
+		}
+	}()
+	return l.Addr().String(), received
+}
+
+func TestSMTPDelivery(t *testing.T) {
+	addr, received := fakeSMTPServer(t)
+
+	saved := cfg
+	t.Cleanup(func() { cfg = saved })
+	cfg.Site.Name = "PUBGO"
+	cfg.SMTP = config.SMTP{From: "site@example.com"}
+
+	form := config.Form{
+		Fields: []config.FormField{
+			{Name: "email", Label: "Email", Type: "email"},
+			{Name: "message", Label: "Message", Type: "textarea"},
+		},
+		To:      []string{"team@example.com", "owner@example.com"},
+		Subject: "Contact",
+	}
+	sub := FormSubmission{
+		Form: "contact",
+		Date: time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC),
+		Values: []FormValue{
+			{Name: "email", Label: "Email", Value: "ann@example.com"},
+			{Name: "message", Label: "Message", Value: "Hello\nthere"},
+		},
+	}
+
+	err := smtpDelivery{Addr: addr}.Deliver(form, sub)
+	if err != nil {
+		t.Fatal("Deliver:", err)
+	}
+
+	var mail fakeMail
+	select {
+	case mail = <-received:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the mail server received no message")
+	}
+
+	if mail.From != "site@example.com" {
+		t.Errorf("MAIL FROM = %q, want site@example.com", mail.From)
+	}
+	if strings.Join(mail.To, ",") != "team@example.com,owner@example.com" {
+		t.Errorf("RCPT TO = %q, want the form's recipients", mail.To)
+	}
+	for _, want := range []string{
+		"From: site@example.com\n",
+		"To: team@example.com, owner@example.com\n",
+		"Subject: [PUBGO] Contact\n",
+		"Reply-To: ann@example.com\n",
+		"Message:\nHello\nthere\n",
+	} {
+		if !strings.Contains(mail.Data, want) {
+			t.Errorf("message lacks %q:\n%s", want, mail.Data)
+		}
+	}
+}
+
+func TestSMTPDeliveryWithoutHost(t *testing.T) {
+	saved := cfg
+	t.Cleanup(func() { cfg = saved })
+	cfg.SMTP = config.SMTP{}
+
+	err := smtpDelivery{}.Deliver(config.Form{To: []string{"team@example.com"}}, FormSubmission{Form: "contact"})
+	if err == nil {
+		t.Error("Deliver succeeded without a mail server")
+	}
+}
@@ -0,0 +1,414 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"html/template"
+	"math"
+	"net/url"
+	"path"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"pubgo/content"
+)
+
+// wordsPerMinute is the reading speed used by readingTime.
+const wordsPerMinute = 200
+
+var htmlTagPattern = regexp.MustCompile(`<[^>]*>`)
+
+// templateFuncs returns the functions available to every template, including
+// custom templates and shortcodes.
+func templateFuncs() template.FuncMap {
+	return template.FuncMap{
+		"dateFormat":    dateFormat,
+		"relURL":        relURL,
+		"absURL":        absURL,
+		"isAbsURL":      isAbsoluteURL,
+		"markdownify":   markdownify,
+		"truncate":      truncate,
+		"where":         where,
+		"sortBy":        sortBy,
+		"first":         first,
+		"readingTime":   readingTime,
+		"dict":          dict,
+		"list":          list,
+		"getEntries":    getEntries,
+		"i18n":          i18n,
+		"comments":      renderComments,
+		"clientMath":    clientMath,
+		"clientMermaid": clientMermaid,
+	}
+}
+
+// dateFormat formats t with a Go time layout. Month and weekday names are
+// translated when a locale is given, or set with site.locale.
+//
+//	{{ dateFormat "2. January 2006" .Date "de" }}
+func dateFormat(layout string, t time.Time, locale ...string) string {
+	loc := cfg.Site.Locale
+	if len(locale) > 0 {
+		loc = locale[0]
+	}
+
+	names, ok := localeNames[strings.ToLower(strings.SplitN(loc, "-", 2)[0])]
+	if !ok {
+		return t.Format(layout)
+	}
+
+	// swap the name elements for markers the layout parser copies verbatim,
+	// longest first since Jan and Mon are prefixes of January and Monday
+	layout = strings.NewReplacer("January", "\x01", "Jan", "\x02", "Monday", "\x03", "Mon", "\x04").Replace(layout)
+	s := t.Format(layout)
+
+	return strings.NewReplacer(
+		"\x01", names.months[t.Month()-1],
+		"\x02", shortName(names.months[t.Month()-1]),
+		"\x03", names.days[t.Weekday()],
+		"\x04", shortName(names.days[t.Weekday()]),
+	).Replace(s)
+}
+
+func shortName(name string) string {
+	if utf8.RuneCountInString(name) <= 3 {
+		return name
+	}
+	return string([]rune(name)[:3])
+}
+
+type localeNameSet struct {
+	months [12]string
+	days   [7]string
+}
+
+// localeNames holds month and weekday names for dateFormat, weekdays
+// starting on Sunday.
+var localeNames = map[string]localeNameSet{
+	"en": {
+		months: [12]string{"January", "February", "March", "April", "May", "June", "July", "August", "September", "October", "November", "December"},
+		days:   [7]string{"Sunday", "Monday", "Tuesday", "Wednesday", "Thursday", "Friday", "Saturday"},
+	},
+	"de": {
+		months: [12]string{"Januar", "Februar", "März", "April", "Mai", "Juni", "Juli", "August", "September", "Oktober", "November", "Dezember"},
+		days:   [7]string{"Sonntag", "Montag", "Dienstag", "Mittwoch", "Donnerstag", "Freitag", "Samstag"},
+	},
+	"fr": {
+		months: [12]string{"janvier", "février", "mars", "avril", "mai", "juin", "juillet", "août", "septembre", "octobre", "novembre", "décembre"},
+		days:   [7]string{"dimanche", "lundi", "mardi", "mercredi", "jeudi", "vendredi", "samedi"},
+	},
+	"es": {
+		months: [12]string{"enero", "febrero", "marzo", "abril", "mayo", "junio", "julio", "agosto", "septiembre", "octubre", "noviembre", "diciembre"},
+		days:   [7]string{"domingo", "lunes", "martes", "miércoles", "jueves", "viernes", "sábado"},
+	},
+	"it": {
+		months: [12]string{"gennaio", "febbraio", "marzo", "aprile", "maggio", "giugno", "luglio", "agosto", "settembre", "ottobre", "novembre", "dicembre"},
+		days:   [7]string{"domenica", "lunedì", "martedì", "mercoledì", "giovedì", "venerdì", "sabato"},
+	},
+	"nl": {
+		months: [12]string{"januari", "februari", "maart", "april", "mei", "juni", "juli", "augustus", "september", "oktober", "november", "december"},
+		days:   [7]string{"zondag", "maandag", "dinsdag", "woensdag", "donderdag", "vrijdag", "zaterdag"},
+	},
+	"pt": {
+		months: [12]string{"janeiro", "fevereiro", "março", "abril", "maio", "junho", "julho", "agosto", "setembro", "outubro", "novembro", "dezembro"},
+		days:   [7]string{"domingo", "segunda-feira", "terça-feira", "quarta-feira", "quinta-feira", "sexta-feira", "sábado"},
+	},
+}
+
+// relURL returns p as a path from the site root, including the path of
+// base_url when the site isn't served from the root of its domain.
+func relURL(p string) string {
+	if isAbsoluteURL(p) {
+		return p
+	}
+
+	base := "/"
+	if u, err := url.Parse(cfg.BaseURL); err == nil && u.Path != "" {
+		base = u.Path
+	}
+
+	joined := path.Join(base, p)
+	if strings.HasSuffix(p, "/") && joined != "/" {
+		joined += "/"
+	}
+	return joined
+}
+
+// absURL returns p as an absolute URL on the host of site.url. Without a
+// site.url it behaves like relURL.
+func absURL(p string) string {
+	if isAbsoluteURL(p) {
+		return p
+	}
+
+	u, err := url.Parse(cfg.Site.URL)
+	if err != nil || u.Host == "" {
+		return relURL(p)
+	}
+
+	return u.Scheme + "://" + u.Host + relURL(p)
+}
+
+// isAbsoluteURL reports whether p is a URL with a scheme or host, which
+// absURL only makes of paths when site.url is set.
+//
+//	{{ if isAbsURL (absURL .URL) }}
+func isAbsoluteURL(p string) bool {
+	u, err := url.Parse(p)
+	return err == nil && (u.Scheme != "" || strings.HasPrefix(p, "//"))
+}
+
+// markdownify renders a string of markdown. A single paragraph is returned
+// without its <p> tags so it can be used inline.
+func markdownify(s string) (template.HTML, error) {
+	html, err := renderMarkdown([]byte(s), false)
+	out := strings.TrimSpace(string(html))
+	if strings.HasPrefix(out, "<p>") && strings.HasSuffix(out, "</p>") && strings.Count(out, "<p>") == 1 {
+		out = strings.TrimSuffix(strings.TrimPrefix(out, "<p>"), "</p>")
+	}
+	return template.HTML(out), err
+}
+
+// truncate shortens s to at most length runes, cutting at a word boundary
+// where possible and adding an ellipsis.
+func truncate(length int, s string) string {
+	if utf8.RuneCountInString(s) <= length {
+		return s
+	}
+
+	runes := []rune(s)[:length]
+	cut := string(runes)
+	if i := strings.LastIndexAny(cut, " \t\n"); i > 0 {
+		cut = cut[:i]
+	}
+	return strings.TrimRight(cut, " \t\n.,;:") + "…"
+}
+
+// readingTime estimates the minutes needed to read a body of text or HTML.
+func readingTime(body interface{}) int {
+	text := htmlTagPattern.ReplaceAllString(fmt.Sprint(body), " ")
+	words := len(strings.Fields(text))
+	return int(math.Max(1, math.Ceil(float64(words)/wordsPerMinute)))
+}
+
+// dict builds a map from key value pairs, for passing several values to a
+// template.
+func dict(values ...interface{}) (map[string]interface{}, error) {
+	if len(values)%2 != 0 {
+		return nil, errors.New("dict: odd number of arguments")
+	}
+
+	m := make(map[string]interface{}, len(values)/2)
+	for i := 0; i < len(values); i += 2 {
+		key, ok := values[i].(string)
+		if !ok {
+			return nil, fmt.Errorf("dict: key %v is not a string", values[i])
+		}
+		m[key] = values[i+1]
+	}
+	return m, nil
+}
+
+// list builds a list from its arguments.
+func list(values ...interface{}) []interface{} {
+	return values
+}
+
+// first returns the first n items of a list.
+func first(n int, list interface{}) (interface{}, error) {
+	v := reflect.ValueOf(list)
+	if v.Kind() != reflect.Slice && v.Kind() != reflect.Array {
+		return nil, fmt.Errorf("first: can't take items from %T", list)
+	}
+	if n < 0 {
+		return nil, errors.New("first: negative count")
+	}
+	if n > v.Len() {
+		n = v.Len()
+	}
+	return v.Slice(0, n).Interface(), nil
+}
+
+// where returns the items of a list whose field (or map key) equals value.
+// An operator may be given between the field and the value: =, !=, <, <=,
+// >, >= or in.
+//
+//	{{ range where .Entries "Author" "pubgo" }}
+//	{{ range where .Entries "Date" ">=" $since }}
+func where(list interface{}, field string, args ...interface{}) (interface{}, error) {
+	op, value := "=", interface{}(nil)
+	switch len(args) {
+	case 1:
+		value = args[0]
+	case 2:
+		op, _ = args[0].(string)
+		value = args[1]
+	default:
+		return nil, errors.New("where: expected a value or an operator and a value")
+	}
+
+	v := reflect.ValueOf(list)
+	if v.Kind() != reflect.Slice && v.Kind() != reflect.Array {
+		return nil, fmt.Errorf("where: can't filter %T", list)
+	}
+
+	out := reflect.MakeSlice(reflect.SliceOf(v.Type().Elem()), 0, v.Len())
+	for i := 0; i < v.Len(); i++ {
+		item := v.Index(i)
+		ok, err := compareValues(fieldValue(item, field), op, value)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			out = reflect.Append(out, item)
+		}
+	}
+	return out.Interface(), nil
+}
+
+// sortBy returns a copy of a list sorted by a field (or map key), ascending
+// unless "desc" is given.
+//
+//	{{ range sortBy .Entries "Title" "desc" }}
+func sortBy(list interface{}, field string, order ...string) (interface{}, error) {
+	v := reflect.ValueOf(list)
+	if v.Kind() != reflect.Slice && v.Kind() != reflect.Array {
+		return nil, fmt.Errorf("sortBy: can't sort %T", list)
+	}
+
+	out := reflect.MakeSlice(reflect.SliceOf(v.Type().Elem()), v.Len(), v.Len())
+	reflect.Copy(out, v)
+
+	desc := len(order) > 0 && strings.EqualFold(order[0], "desc")
+	sort.SliceStable(out.Interface(), func(i, j int) bool {
+		a := fieldValue(out.Index(i), field)
+		b := fieldValue(out.Index(j), field)
+		if desc {
+			a, b = b, a
+		}
+		less, _ := compareValues(a, "<", b)
+		return less
+	})
+	return out.Interface(), nil
+}
+
+// fieldValue returns a struct field, map key or method result of item, or
+// nil if it has none by that name.
+func fieldValue(item reflect.Value, name string) interface{} {
+	for item.Kind() == reflect.Interface || item.Kind() == reflect.Ptr {
+		if item.IsNil() {
+			return nil
+		}
+		item = item.Elem()
+	}
+
+	switch item.Kind() {
+	case reflect.Struct:
+		if f := item.FieldByName(name); f.IsValid() && f.CanInterface() {
+			return f.Interface()
+		}
+	case reflect.Map:
+		if f := item.MapIndex(reflect.ValueOf(name)); f.IsValid() {
+			return f.Interface()
+		}
+	}
+
+	if m := item.MethodByName(name); m.IsValid() && m.Type().NumIn() == 0 && m.Type().NumOut() >= 1 {
+		return m.Call(nil)[0].Interface()
+	}
+	return nil
+}
+
+// compareValues compares two values of the kinds found in entries and front
+// matter: strings, numbers, booleans and times.
+func compareValues(a interface{}, op string, b interface{}) (bool, error) {
+	if op == "in" {
+		v := reflect.ValueOf(b)
+		if v.Kind() != reflect.Slice && v.Kind() != reflect.Array {
+			return false, fmt.Errorf("where: in needs a list, got %T", b)
+		}
+		for i := 0; i < v.Len(); i++ {
+			if eq, _ := compareValues(a, "=", v.Index(i).Interface()); eq {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+
+	var cmp int
+	switch x := a.(type) {
+	case time.Time:
+		y, _ := b.(time.Time)
+		switch {
+		case x.Before(y):
+			cmp = -1
+		case x.After(y):
+			cmp = 1
+		}
+	default:
+		xf, xok := toFloat(a)
+		yf, yok := toFloat(b)
+		if xok && yok {
+			switch {
+			case xf < yf:
+				cmp = -1
+			case xf > yf:
+				cmp = 1
+			}
+		} else {
+			cmp = strings.Compare(fmt.Sprint(a), fmt.Sprint(b))
+		}
+	}
+
+	switch op {
+	case "=", "==", "eq":
+		return cmp == 0, nil
+	case "!=", "ne":
+		return cmp != 0, nil
+	case "<", "lt":
+		return cmp < 0, nil
+	case "<=", "le":
+		return cmp <= 0, nil
+	case ">", "gt":
+		return cmp > 0, nil
+	case ">=", "ge":
+		return cmp >= 0, nil
+	}
+	return false, fmt.Errorf("where: unknown operator %q", op)
+}
+
+func toFloat(v interface{}) (float64, bool) {
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(rv.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(rv.Uint()), true
+	case reflect.Float32, reflect.Float64:
+		return rv.Float(), true
+	}
+	return 0, false
+}
+
+// getEntries returns the entries of the collection page called name, so a
+// template can list entries from another collection. On multilingual sites
+// the entries of the language given are returned, or the default one.
+// Protected entries are left out.
+//
+//	{{ range first 3 (getEntries "posts" .Lang) }}
+func getEntries(name string, lang ...string) (content.Entries, error) {
+	l := defaultLanguage()
+	if len(lang) > 0 && lang[0] != "" {
+		l = lang[0]
+	}
+	for _, page := range cfg.Site.Pages {
+		if page.Name == name && page.Collection {
+			return publicEntries(localizePage(page, l)), nil
+		}
+	}
+	return nil, fmt.Errorf("getEntries: no collection named %q", name)
+}
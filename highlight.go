@@ -1,8 +1,14 @@
 package main
 
 import (
+	"bytes"
+	"fmt"
+	"html/template"
 	"io"
 	"log"
+	"regexp"
+	"strconv"
+	"strings"
 
 	mdhtml "github.com/gomarkdown/markdown/html"
 	"github.com/gomarkdown/markdown/parser"
@@ -15,20 +21,109 @@ import (
 )
 
 var (
-	htmlFormatter  *html.Formatter
-	highlightStyle *chroma.Style
+	// fencePattern matches an opening or closing fence line and
+	// fenceAttrsPattern the info string of one with attributes after the
+	// language, e.g. ```go {linenos=true}
+	fencePattern      = regexp.MustCompile("^ {0,3}(`{3,}|~{3,})(.*)$")
+	fenceAttrsPattern = regexp.MustCompile(`^[ \t]*([^\s{}]+)[ \t]+\{([^}]*)\}[ \t]*$`)
+	codeAttrPattern   = regexp.MustCompile(`([\w-]+)\s*=\s*("[^"]*"|\[[^\]]*\]|[^,\s]+)`)
+	lineRangePattern  = regexp.MustCompile(`(\d+)(?:-(\d+))?`)
+	cssRulePattern    = regexp.MustCompile(`(/\* [^*]* \*/ )(\.)`)
 )
 
+// codeBlockAttrs are the options given in braces after a fence's language.
+type codeBlockAttrs struct {
+	LineNumbers      bool
+	LineNumbersTable bool
+	LineNumberStart  int
+	HighlightLines   [][2]int
+	Title            string
+	Copy             bool
+}
+
+// normalizeFenceInfo rewrites ```go {attrs} fences as ```{go attrs}, the
+// only form in which the markdown parser keeps the attributes in the code
+// block's info string. Fences nested inside another code block are left alone.
+func normalizeFenceInfo(md []byte) []byte {
+	lines := bytes.Split(md, []byte("\n"))
+	var open []byte
+
+	for i, line := range lines {
+		m := fencePattern.FindSubmatch(line)
+		if m == nil {
+			continue
+		}
+
+		fence, info := m[1], m[2]
+		if open != nil {
+			// a closing fence uses the same character, is at least as long
+			// and has no info string
+			if fence[0] == open[0] && len(fence) >= len(open) && len(bytes.TrimSpace(info)) == 0 {
+				open = nil
+			}
+			continue
+		}
+
+		open = fence
+		if a := fenceAttrsPattern.FindSubmatch(info); a != nil {
+			prefix := line[:len(line)-len(info)]
+			lines[i] = []byte(fmt.Sprintf("%s{%s %s}", prefix, a[1], a[2]))
+		}
+	}
+
+	return bytes.Join(lines, []byte("\n"))
+}
+
+// parseCodeBlockAttrs parses the attributes of a code block's info string:
+// linenos (true, false or table), linenostart, hl_lines ([3, "5-7"]), title
+// and copy.
+func parseCodeBlockAttrs(info string) codeBlockAttrs {
+	attrs := codeBlockAttrs{
+		LineNumberStart: 1,
+		Copy:            cfg.Site.Theme.CodeCopy,
+	}
+
+	for _, m := range codeAttrPattern.FindAllStringSubmatch(info, -1) {
+		value := strings.Trim(m[2], `"`)
+		switch m[1] {
+		case "linenos":
+			attrs.LineNumbers = value == "true" || value == "table" || value == "inline"
+			attrs.LineNumbersTable = value == "table"
+		case "linenostart":
+			if n, err := strconv.Atoi(value); err == nil {
+				attrs.LineNumberStart = n
+			}
+		case "hl_lines":
+			for _, r := range lineRangePattern.FindAllStringSubmatch(value, -1) {
+				start, _ := strconv.Atoi(r[1])
+				end := start
+				if r[2] != "" {
+					end, _ = strconv.Atoi(r[2])
+				}
+				attrs.HighlightLines = append(attrs.HighlightLines, [2]int{start, end})
+			}
+		case "title":
+			attrs.Title = value
+		case "copy":
+			attrs.Copy = value == "true"
+		}
+	}
+
+	return attrs
+}
+
 // based on https://github.com/alecthomas/chroma/blob/master/quick/quick.go
-func htmlHighlight(w io.Writer, source, lang, defaultLang string) error {
-	htmlFormatter = html.New(html.Standalone(false), html.TabWidth(2))
+// The formatter is made for each code block, as the options differ between
+// blocks and pages are rendered concurrently while serving.
+func htmlHighlight(w io.Writer, source, lang, defaultLang string, options ...html.Option) error {
+	options = append([]html.Option{html.Standalone(false), html.TabWidth(2), html.WithClasses(true)}, options...)
+	htmlFormatter := html.New(options...)
 	if htmlFormatter == nil {
 		log.Println("couldn't create html formatter")
 	}
-	var styleName string
-	styleName = cfg.Site.Theme.SyntaxTheme
+	styleName := cfg.Site.Theme.SyntaxTheme
 
-	highlightStyle = styles.Get(styleName)
+	highlightStyle := styles.Get(styleName)
 	if highlightStyle == nil {
 		log.Printf("didn't find style '%s'", styleName)
 	}
@@ -51,19 +146,122 @@ func htmlHighlight(w io.Writer, source, lang, defaultLang string) error {
 	return htmlFormatter.Format(w, highlightStyle, it)
 }
 
-// an actual rendering of Paragraph is more complicated
+// writeSyntaxCSS writes the stylesheet for the classes emitted by
+// htmlHighlight, generated from the theme's syntax_theme. When a dark syntax
+// theme is set its rules follow the theme's color scheme strategy.
+func writeSyntaxCSS(w io.Writer) error {
+	formatter := html.New(
+		html.WithClasses(true),
+		html.TabWidth(2),
+		html.WithLineNumbers(true),
+		html.LineNumbersInTable(true),
+	)
+
+	err := formatter.WriteCSS(w, styles.Get(cfg.Site.Theme.SyntaxTheme))
+	if err != nil {
+		return err
+	}
+
+	dark := cfg.Site.Theme.Dark.SyntaxTheme
+	if dark == "" {
+		return nil
+	}
+
+	var buf bytes.Buffer
+	err = formatter.WriteCSS(&buf, styles.Get(dark))
+	if err != nil {
+		return err
+	}
+
+	if cfg.Site.Theme.Scheme == "toggle" {
+		fmt.Fprint(w, scopeCSS(buf.String(), ":root[data-theme=dark]"))
+		fmt.Fprintln(w, "@media (prefers-color-scheme: dark) {")
+		fmt.Fprint(w, scopeCSS(buf.String(), ":root:not([data-theme=light])"))
+	} else {
+		fmt.Fprintln(w, "@media (prefers-color-scheme: dark) {")
+		fmt.Fprint(w, buf.String())
+	}
+	_, err = fmt.Fprintln(w, "}")
+	return err
+}
+
+// scopeCSS prefixes the selector of every rule written by chroma's WriteCSS.
+func scopeCSS(css, scope string) string {
+	return cssRulePattern.ReplaceAllString(css, "$1"+scope+" $2")
+}
+
+// renderCode highlights a code block, applying the fence attributes and
+// wrapping it with a title bar and copy button when asked for.
 func renderCode(w io.Writer, codeBlock *ast.CodeBlock, entering bool) {
 	defaultLang := ""
-	lang := string(codeBlock.Info)
-	htmlHighlight(w, string(codeBlock.Literal), lang, defaultLang)
+	lang := codeBlockLang(codeBlock)
+	attrs := parseCodeBlockAttrs(string(codeBlock.Info))
+	source := string(codeBlock.Literal)
+
+	options := []html.Option{
+		html.WithLineNumbers(attrs.LineNumbers),
+		html.LineNumbersInTable(attrs.LineNumbersTable),
+		html.BaseLineNumber(attrs.LineNumberStart),
+		html.HighlightLines(attrs.HighlightLines),
+	}
+
+	if attrs.Title == "" && !attrs.Copy {
+		htmlHighlight(w, source, lang, defaultLang, options...)
+		return
+	}
+
+	fmt.Fprint(w, `<div class="code-block"><div class="code-header">`)
+	fmt.Fprintf(w, `<span class="code-title">%s</span>`, template.HTMLEscapeString(attrs.Title))
+	if attrs.Copy {
+		fmt.Fprintf(w, `<button type="button" class="code-copy" data-code="%s">Copy</button>`, template.HTMLEscapeString(source))
+	}
+	fmt.Fprint(w, `</div>`)
+	htmlHighlight(w, source, lang, defaultLang, options...)
+	fmt.Fprint(w, `</div>`)
 }
 
-func myRenderHook(w io.Writer, node ast.Node, entering bool) (ast.WalkStatus, bool) {
-	if code, ok := node.(*ast.CodeBlock); ok {
-		renderCode(w, code, entering)
-		return ast.GoToNext, true
+// newRenderHook returns the render hook for code blocks, math and mermaid
+// diagrams. Code blocks are only highlighted when syntax is set.
+func newRenderHook(syntax bool) mdhtml.RenderNodeFunc {
+	return func(w io.Writer, node ast.Node, entering bool) (ast.WalkStatus, bool) {
+		switch n := node.(type) {
+		case *ast.CodeBlock:
+			switch codeBlockLang(n) {
+			case "math":
+				if mathEnabled() {
+					renderMath(w, n.Literal, true)
+					return ast.GoToNext, true
+				}
+			case "mermaid":
+				if cfg.Site.Theme.Mermaid {
+					renderMermaid(w, n.Literal)
+					return ast.GoToNext, true
+				}
+			}
+			if syntax {
+				renderCode(w, n, entering)
+				return ast.GoToNext, true
+			}
+		case *ast.MathBlock:
+			if entering {
+				renderMath(w, n.Literal, true)
+			}
+			return ast.GoToNext, true
+		case *ast.Math:
+			renderMath(w, n.Literal, false)
+			return ast.GoToNext, true
+		}
+		return ast.GoToNext, false
 	}
-	return ast.GoToNext, false
+}
+
+// codeBlockLang returns the language from a fenced code block's info string.
+func codeBlockLang(codeBlock *ast.CodeBlock) string {
+	fields := strings.Fields(string(codeBlock.Info))
+	if len(fields) == 0 {
+		return ""
+	}
+	return fields[0]
 }
 
 func newCustomizedRender(toc bool, syntax bool) (*mdhtml.Renderer, *parser.Parser) {
@@ -73,15 +271,19 @@ func newCustomizedRender(toc bool, syntax bool) (*mdhtml.Renderer, *parser.Parse
 		flags = mdhtml.TOC
 	}
 
+	// $ and $$ are only treated as math when a math renderer is configured
 	extensions := parser.CommonExtensions | parser.AutoHeadingIDs
+	if !mathEnabled() {
+		extensions &^= parser.MathJax
+	}
 	p := parser.NewWithExtensions(extensions)
 
 	opts := mdhtml.RendererOptions{
 		Flags: mdhtml.CommonFlags | flags,
 	}
 
-	if syntax {
-		opts.RenderNodeHook = myRenderHook
+	if syntax || mathEnabled() || cfg.Site.Theme.Mermaid {
+		opts.RenderNodeHook = newRenderHook(syntax)
 	}
 
 	return mdhtml.NewRenderer(opts), p
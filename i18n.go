@@ -0,0 +1,309 @@
+package main
+
+import (
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"pubgo/config"
+	"pubgo/content"
+
+	"gopkg.in/yaml.v2"
+)
+
+// translations holds the translated strings of each language, read from
+// <content_dir>/i18n/<language>.yaml.
+var translations = make(map[string]map[string]string)
+
+// languageCodes returns the configured languages ordered by weight. Sites
+// without languages have a single unnamed one, "".
+func languageCodes() []string {
+	if len(cfg.Languages) == 0 {
+		return []string{""}
+	}
+
+	var codes []string
+	for code := range cfg.Languages {
+		codes = append(codes, code)
+	}
+	sort.Slice(codes, func(i, j int) bool {
+		a, b := cfg.Languages[codes[i]], cfg.Languages[codes[j]]
+		if a.Weight != b.Weight {
+			return a.Weight < b.Weight
+		}
+		return codes[i] < codes[j]
+	})
+	return codes
+}
+
+// defaultLanguage returns the language served without a URL prefix.
+func defaultLanguage() string {
+	if cfg.DefaultLanguage != "" {
+		return cfg.DefaultLanguage
+	}
+	return languageCodes()[0]
+}
+
+// languagePrefix returns the URL prefix of a language, e.g. /de.
+func languagePrefix(lang string) string {
+	if lang == "" || lang == defaultLanguage() {
+		return ""
+	}
+	return "/" + lang
+}
+
+// splitLanguage splits the language prefix from a request path, returning
+// the default language for paths without one.
+func splitLanguage(p string) (string, string) {
+	parts := strings.SplitN(strings.TrimPrefix(p, "/"), "/", 2)
+	if _, ok := cfg.Languages[parts[0]]; ok && parts[0] != defaultLanguage() {
+		if len(parts) == 1 {
+			return parts[0], "/"
+		}
+		return parts[0], "/" + parts[1]
+	}
+	return defaultLanguage(), p
+}
+
+// localizePage returns the page as published in lang, with its path under
+// the language prefix.
+func localizePage(page config.Page, lang string) config.Page {
+	page.Lang = lang
+	page.Path = languagePrefix(lang) + page.Path
+	return page
+}
+
+// localizedPages returns the site's pages as published in lang. Pages
+// without a translation are left out of the navigation.
+func localizedPages(lang string) config.Pages {
+	pages := make(config.Pages)
+	for key, page := range cfg.Site.Pages {
+		page = localizePage(page, lang)
+		if !page.Collection && lang != defaultLanguage() && unlocalizedPath(page) != "/" {
+			if _, ok := localizedFile(lang, page.Name+".md"); !ok {
+				page.HideFromNav = true
+			}
+		}
+		// pages left out of static builds have nothing to link to
+		if cfg.Mode == "build" && !publishedAccess(page).Public() {
+			page.HideFromNav = true
+		}
+		pages[key] = page
+	}
+	return pages
+}
+
+// unlocalizedPath returns a page path without its language prefix.
+func unlocalizedPath(page config.Page) string {
+	return strings.TrimPrefix(page.Path, languagePrefix(page.Lang))
+}
+
+// localizedSite returns the site settings for lang, with its pages and the
+// title and description set for the language.
+func localizedSite(lang string) config.Site {
+	site := cfg.Site
+	site.Pages = localizedPages(lang)
+	if l, ok := cfg.Languages[lang]; ok {
+		if l.Title != "" {
+			site.Title = l.Title
+		}
+		if l.Description != "" {
+			site.Description = l.Description
+		}
+		if l.Locale != "" {
+			site.Locale = l.Locale
+		}
+	}
+	return site
+}
+
+// pageByName returns the configured page called name.
+func pageByName(name string) (config.Page, bool) {
+	for _, page := range cfg.Site.Pages {
+		if page.Name == name {
+			return page, true
+		}
+	}
+	return config.Page{}, false
+}
+
+// languageRoot returns the directory holding the content of lang, the
+// language's own content_dir if it has one.
+func languageRoot(lang string) string {
+	if l, ok := cfg.Languages[lang]; ok && l.ContentDir != "" {
+		return filepath.Join(cfg.ContentDir, l.ContentDir)
+	}
+	return cfg.ContentDir
+}
+
+// localizedFile finds the file holding the lang version of rel, a markdown
+// file path relative to the content directory like posts/hello.md. It looks
+// in the language's content directory, then for posts/hello.de.md, and for
+// the default language posts/hello.md. When there is none, the path rel
+// would have is returned along with false.
+func localizedFile(lang, rel string) (string, bool) {
+	plain := filepath.Join(languageRoot(lang), rel)
+	if lang == "" {
+		_, err := os.Stat(plain)
+		return plain, err == nil
+	}
+
+	candidates := []string{
+		filepath.Join(cfg.ContentDir, strings.TrimSuffix(rel, ".md")+"."+lang+".md"),
+	}
+	if languageRoot(lang) != cfg.ContentDir || lang == defaultLanguage() {
+		candidates = append([]string{plain}, candidates...)
+	}
+
+	for _, file := range candidates {
+		if info, err := os.Stat(file); err == nil && !info.IsDir() {
+			return file, true
+		}
+	}
+	return plain, false
+}
+
+// localizedHome returns the file holding the lang version of the home page,
+// which is rel, falling back to the default language's. Every page links
+// its logo to the home page of its language, so it exists in each.
+func localizedHome(lang, rel string) (string, bool) {
+	if file, ok := localizedFile(lang, rel); ok {
+		return file, true
+	}
+	return localizedFile(defaultLanguage(), rel)
+}
+
+// splitLanguageSuffix splits the language from a file name like
+// hello.de.md, returning hello.md and de. Names without a configured
+// language are returned as they are.
+func splitLanguageSuffix(name string) (string, string) {
+	base := strings.TrimSuffix(name, ".md")
+	ext := path.Ext(base)
+	if ext == "" {
+		return name, ""
+	}
+	if _, ok := cfg.Languages[ext[1:]]; !ok {
+		return name, ""
+	}
+	return strings.TrimSuffix(base, ext) + ".md", ext[1:]
+}
+
+// localizeFiles picks the files of lang from the markdown files of a
+// collection and returns them without their language suffix.
+func localizeFiles(files []string, lang string) []string {
+	if lang == "" {
+		return files
+	}
+
+	ownDir := languageRoot(lang) != cfg.ContentDir
+	seen := make(map[string]bool)
+	var localized []string
+	for _, file := range files {
+		name, fileLang := splitLanguageSuffix(file)
+		if fileLang == "" && (ownDir || lang == defaultLanguage()) {
+			fileLang = lang
+		}
+		if fileLang != lang || seen[name] {
+			continue
+		}
+		seen[name] = true
+		localized = append(localized, name)
+	}
+	return localized
+}
+
+// entryTranslations returns the versions of a page, or of an entry when
+// entryFile is set, in each language it is translated to.
+func entryTranslations(page config.Page, entryFile string) []content.Translation {
+	original, ok := pageByName(page.Name)
+	if len(cfg.Languages) == 0 || !ok {
+		return nil
+	}
+
+	var list []content.Translation
+	for _, lang := range languageCodes() {
+		p := localizePage(original, lang)
+
+		url := p.Path
+		ok := true
+		if page.Collection && entryFile != "" {
+			md := strings.TrimSuffix(entryFile, path.Ext(entryFile)) + ".md"
+			_, ok = localizedFile(lang, filepath.Join(page.Name, md))
+			url = strings.TrimSuffix(p.Path, "/") + "/" + strings.TrimSuffix(md, ".md") + ".html"
+		} else if !page.Collection {
+			_, ok = localizedFile(lang, page.Name+".md")
+		}
+		if !ok {
+			continue
+		}
+
+		list = append(list, content.Translation{
+			Lang:    lang,
+			Name:    cfg.Languages[lang].Name,
+			URL:     url,
+			Current: lang == page.Lang,
+			Default: lang == defaultLanguage(),
+		})
+	}
+	return list
+}
+
+// localizeContent sets the language, localized site settings and
+// translations of the page being rendered.
+func localizeContent(cont *content.Content) {
+	cont.Lang = cont.Page.Lang
+	cont.LangPath = languagePrefix(cont.Lang)
+	cont.Site = localizedSite(cont.Lang)
+	cont.Translations = entryTranslations(cont.Page, cont.Entry.FileName)
+}
+
+// loadTranslations reads the translated strings of every language.
+func loadTranslations() {
+	translations = make(map[string]map[string]string)
+	for _, lang := range languageCodes() {
+		if lang == "" {
+			continue
+		}
+
+		file := filepath.Join(cfg.ContentDir, "i18n", lang+".yaml")
+		data, err := os.ReadFile(file)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			report.Error("Error reading translations:", err)
+			continue
+		}
+
+		strs := make(map[string]string)
+		err = yaml.Unmarshal(data, &strs)
+		if err != nil {
+			report.Error("Error parsing translations", file+":", err)
+			continue
+		}
+		log.Println("Loaded", len(strs), "translations for", lang)
+		translations[lang] = strs
+	}
+}
+
+// i18n translates a string to the given language, or the default one. Keys
+// without a translation are returned as they are, so templates can use the
+// text of the default language as the key.
+//
+//	{{ i18n "Related" .Lang }}
+func i18n(key string, lang ...string) string {
+	l := defaultLanguage()
+	if len(lang) > 0 && lang[0] != "" {
+		l = lang[0]
+	}
+	if s, ok := translations[l][key]; ok {
+		return s
+	}
+	if s, ok := translations[defaultLanguage()][key]; ok {
+		return s
+	}
+	return key
+}
@@ -1,48 +1,88 @@
 package main
 
 import (
-	"crypto/subtle"
 	"embed"
 	"flag"
+	"fmt"
 	"html/template"
-	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
+	"path"
 	"path/filepath"
 	"strconv"
 	"strings"
 
 	"pubgo/config"
 	"pubgo/content"
+	"pubgo/theme"
 )
 
-//go:embed templates/*.tmpl
+//go:embed templates/*.tmpl templates/layouts/*.tmpl templates/shortcodes/*.tmpl
 var templateFiles embed.FS
 var entries = make(map[string][]content.Entry)
 var cfg = config.NewConfig()
 var templates *template.Template
+var themes []theme.Theme
 
-func init() {
-	// Load config from YAML file
-	configFile := flag.String("config", "config.yaml", "Path to config file")
-	runMode := flag.String("mode", "serve", "Run mode: <serve> or <build> static site")
+// commandArgs are the arguments following the mode given as a command,
+// e.g. the name and role of pubgo user alice admin.
+var commandArgs []string
+
+// configFile is the config file given with -config.
+var configFile = "config.yaml"
+
+// summaryFile is where builds write their errors and warnings as JSON,
+// given with -summary.
+var summaryFile string
+
+// parseFlags sets up the config from the command line.
+func parseFlags() {
+	flag.StringVar(&configFile, "config", configFile, "Path to config file")
+	flag.StringVar(&summaryFile, "summary", "", "Write the build's errors and warnings as JSON to this file")
+	runMode := flag.String("mode", "serve", "Run mode: <serve>, <build> static site, <check> links, list <templates>, add a <user> or <hash> a password")
 	outputDir := flag.String("out", "./out", "Output directory for static site")
 	contentDir := flag.String("content_dir", "./website", "Content directory")
-	adminUser := flag.String("admin_user", "", "Admin username")
-	adminPass := flag.String("admin_pass", "", "Admin password")
+	strict := flag.Bool("strict", false, "Exit non-zero if the build reports any errors")
+	clean := flag.Bool("clean", false, "Remove files from the output directory the build didn't produce")
+	dev := flag.Bool("dev", false, "Show template errors in an error overlay when serving")
 
 	flag.Parse()
 	cfg.ContentDir = *contentDir
 	cfg.OutputDir = *outputDir
 	cfg.Mode = *runMode
-	cfg.AdminUser = *adminUser
-	cfg.AdminPass = *adminPass
+	cfg.Strict = *strict
+	cfg.Clean = *clean
+	cfg.Dev = *dev
+
+	// the mode may also be given as a command, e.g. pubgo templates
+	if flag.NArg() > 0 {
+		cfg.Mode = flag.Arg(0)
+		commandArgs = flag.Args()[1:]
+	}
+}
 
-	config.LoadConfig(*configFile, &cfg)
+// setup loads the config file and the themes, translations and templates
+// of the site, creating the content directories and page files missing.
+func setup() {
+	config.LoadConfig(configFile, &cfg)
 	primeDirectory(cfg.ContentDir)
+	primeDirectory(filepath.Join(cfg.ContentDir, "templates"))
+	loadThemes(configFile)
+
+	for key, page := range cfg.Site.Pages {
+		// docs collections default to the docs layout in manual order
+		if page.Docs {
+			page.Collection = true
+			if page.Layout == "" {
+				page.Layout = "docs"
+			}
+			if page.SortBy == "" {
+				page.SortBy = "weight"
+			}
+			cfg.Site.Pages[key] = page
+		}
 
-	for _, page := range cfg.Site.Pages {
 		if page.Collection {
 			primeDirectory(filepath.Join(cfg.ContentDir, page.Name))
 		} else {
@@ -50,90 +90,96 @@ func init() {
 		}
 	}
 
-	// if runmode is build and output directory doesn't exist, create it
-	if cfg.Mode == "build" {
-		primeDirectory(cfg.OutputDir)
+	if _, ok := commentProviders[cfg.Comments.Provider]; !ok {
+		report.Error("Unknown comments provider", cfg.Comments.Provider)
+	}
 
-		// Load entries
-		for _, page := range cfg.Site.Pages {
-			if page.Collection {
-				loadCollectionEntries(page)
-			} else {
-				loadSingleEntry(page)
-			}
-		}
+	if cfg.Mode == "serve" {
+		checkUsers()
+	}
+
+	checkAccess()
+	checkForms()
+	checkMath()
+	loadTranslations()
+	loadTemplates()
+}
 
-		printEntries()
+// loadConfig loads the config file and the themes for the commands that
+// only read the site, without creating anything. A missing config file
+// leaves the defaults.
+func loadConfig() {
+	if _, err := os.Stat(configFile); err == nil {
+		config.LoadConfig(configFile, &cfg)
 	}
+	loadThemes(configFile)
+}
 
+// loadThemes loads the theme chosen with site.theme_name along with the
+// themes it extends. Their theme.yaml colors become the defaults for the
+// site's theme, which the config file can still override.
+func loadThemes(configFile string) {
 	var err error
-	templates, err = template.New("").ParseFS(templateFiles, "templates/*.tmpl")
-
+	themes, err = theme.Load(cfg.Site.ThemeName, filepath.Join(cfg.ContentDir, "themes"))
 	if err != nil {
-		log.Println("Error loading templates:", err)
+		report.Error("Error loading theme:", err)
+		return
+	}
+	if len(themes) == 0 {
+		return
 	}
 
-	// Load custom templates from ContentDir/templates to override default templates
-	customTemplatesDir := filepath.Join(cfg.ContentDir, "templates")
-	primeDirectory(customTemplatesDir)
-
-	if _, err := os.Stat(customTemplatesDir); err == nil {
-		log.Println("Loading custom templates from", customTemplatesDir)
-
-		// Print *.html files in custom templates directory
-		files, err := ioutil.ReadDir(customTemplatesDir)
+	siteTheme := config.NewConfig().Site.Theme
+	for _, t := range themes {
+		log.Println("Using theme", t.Name)
+		err = t.ApplyDefaults(&siteTheme)
 		if err != nil {
-			log.Println("Error reading custom templates directory:", err)
-		}
-
-		var count int
-		for _, file := range files {
-			if strings.HasSuffix(file.Name(), ".tmpl") {
-				log.Println("Found custom template:", file.Name())
-				count++
-			}
+			report.Error("Error loading theme defaults:", err)
 		}
+	}
 
-		if count == 0 {
-			log.Println("No custom templates found")
-		} else {
-			log.Println("Found", count, "custom templates")
-			templates, err = templates.New("").ParseGlob(filepath.Join(customTemplatesDir, "*.tmpl"))
-			if err != nil {
-				log.Println("Error loading custom templates:", err)
-			}
-		}
+	err = config.LoadTheme(configFile, &siteTheme)
+	if err != nil {
+		report.Error("Error loading theme config:", err)
+		return
 	}
+	cfg.Site.Theme = siteTheme
 }
 
-func createEntry(page config.Page, subDir, filename string, data []byte) content.Entry {
+// createEntry reads the entry filename of page. Entries that can't be read
+// are reported and returned with ok false, so they are skipped.
+func createEntry(page config.Page, subDir, filename string, data []byte) (entry content.Entry, ok bool) {
 	var filePath string
 
 	if subDir != "" {
-		filePath = filepath.Join(cfg.ContentDir, page.Name, filename)
+		filePath, _ = localizedFile(page.Lang, filepath.Join(page.Name, filename))
 	} else {
-		filePath = filepath.Join(cfg.ContentDir, filename)
+		filePath, _ = localizedFile(page.Lang, filename)
 	}
 
 	data, err := os.ReadFile(filePath)
 	if err != nil {
-		log.Println("Error reading entry file:", err)
+		report.Error("Error reading entry file:", err)
+		return content.Entry{}, false
 	}
 
-	entry, _, err := content.ParseEntry(data)
-	if err != nil {
-		log.Println("Error parsing entry:", err)
+	entry, _, err = content.ParseEntry(data)
+	if err != nil && err != content.ErrNoFrontMatter {
+		report.Error("Error parsing entry", filePath+":", err)
 	}
 
-	if cfg.Mode == "serve" {
-		entry.FileName = strings.Replace(filename, ".md", ".html", 1)
-	} else {
+	// the checker crawls the handlers serving the site, so it names
+	// entries the way they are served
+	if cfg.Mode == "build" {
 		entry.FileName = filename
+	} else {
+		entry.FileName = strings.Replace(filename, ".md", ".html", 1)
 	}
 
-	entry.Page = page.Name
+	// entries link to the page's path in their language, e.g. de/blog
+	entry.Page = path.Join(strings.TrimPrefix(languagePrefix(page.Lang), "/"), page.Name)
 
-	return entry
+	return entry, true
 }
 
 func printEntries() {
@@ -148,12 +194,12 @@ func logRequest(req *http.Request) {
 	log.Printf("%s\t%s\t%s\t%s", req.Method, req.URL.Path, req.RemoteAddr, req.UserAgent())
 }
 
-func loadEntries() {
+func loadEntries(pages config.Pages) {
 	// Clear entries
 	entries = make(map[string][]content.Entry, 0)
 
 	// Load entries
-	for _, page := range cfg.Site.Pages {
+	for _, page := range pages {
 		if page.Collection {
 			loadCollectionEntries(page)
 		} else {
@@ -165,81 +211,205 @@ func loadEntries() {
 }
 
 func main() {
-	if cfg.Mode == "build" {
+	parseFlags()
+
+	switch cfg.Mode {
+	case "build":
+		setup()
+		built := buildSite()
+		report.Summary()
+		if summaryFile != "" {
+			err := report.WriteSummary(summaryFile)
+			if err != nil {
+				log.Println("Error writing summary:", err)
+			}
+		}
+		if !built || cfg.Strict && report.Failed() {
+			os.Exit(1)
+		}
 
-		// using os.Read and os.Write copy files from contentdir/static/ to outputdir/static/
-		err := walkAndCopyFiles(cfg.ContentDir, cfg.OutputDir)
+	case "check":
+		setup()
+		checkSite()
 
-		if err != nil {
-			log.Println("Error walking static directory:", err)
-			panic(err)
+		report.Summary()
+		if report.Failed() {
+			os.Exit(1)
 		}
 
-		// make outputdir/css if it doesn't exist
-		primeDirectory(filepath.Join(cfg.OutputDir, "css"))
+	case "templates":
+		loadConfig()
+		loadTemplates()
+		listTemplates()
 
-		// render css from template and write to outputdir/css/style.css
-		wr, err := os.Create(cfg.OutputDir + "/css" + "/style.css")
+	case "user":
+		loadConfig()
+		err := addUser(commandArgs)
 		if err != nil {
-			log.Println("Error creating file:", err)
+			log.Fatal("Error adding user: ", err)
 		}
+		log.Println("Saved user to", cfg.Admin.UsersFile)
 
-		err = templates.ExecuteTemplate(wr, "styleCSS", cfg.Site)
+	case "hash":
+		hash, err := hashPassword()
 		if err != nil {
-			log.Println("Error executing template:", err)
+			log.Fatal("Error hashing password: ", err)
 		}
+		fmt.Println(hash)
 
-		buildPages()
-	}
-
-	if cfg.Mode == "serve" {
+	case "serve":
+		setup()
+		setupContentRepository()
 		serveStaticFiles()
 		serveCSSTemplate()
+		serveSyntaxCSS()
+		serveScripts()
 		setupRouter()
 
 		// Start web server
 		log.Println("Starting web server on port", cfg.Port)
-		err := http.ListenAndServe(":"+strconv.Itoa(cfg.Port), nil)
+		err := http.ListenAndServe(":"+strconv.Itoa(cfg.Port), lockedHandler(http.DefaultServeMux))
 		if err != nil {
 			log.Fatal("Web server error:", err)
 		}
+
+	default:
+		log.Fatalf("Unknown mode %q, use serve, build, check, templates, user or hash", cfg.Mode)
 	}
 }
 
-func buildPages() {
-	nonCollectionPages := make(config.Pages)
-	collectionPages := make(config.Pages)
+// buildSite builds the static site next to the output directory and swaps
+// it into place once done, so the site stays whole while building. Files
+// in the output directory the build doesn't produce are kept unless
+// -clean is given. A build that panics, or reports errors with -strict,
+// leaves the previous site in place.
+func buildSite() bool {
+	out := cfg.OutputDir
+	// swap the directory a symlinked output directory points to
+	target, err := filepath.EvalSymlinks(out)
+	if err != nil {
+		target = filepath.Clean(out)
+	}
+	staging, err := stageOutputDir(target, cfg.Clean)
+	if err != nil {
+		report.Error("Error preparing build directory:", err)
+		return false
+	}
 
-	for _, page := range cfg.Site.Pages {
-		if page.Collection {
-			collectionPages[page.Name] = page
-		} else {
-			nonCollectionPages[page.Name] = page
+	// gone once swapped into place
+	defer os.RemoveAll(staging)
+	defer func() { cfg.OutputDir = out }()
+
+	errs := report.ErrorCount()
+	cfg.OutputDir = staging
+	writeSite()
+
+	if cfg.Strict && report.ErrorCount() > errs {
+		log.Println("Keeping the previous site in", out+", the build reported errors")
+		return false
+	}
+	err = swapDirectory(staging, target)
+	if err != nil {
+		report.Error("Error moving the build into place:", err)
+		return false
+	}
+	return true
+}
+
+// writeSite writes the static site to the output directory: the static
+// files of the themes and the content directory, the stylesheets and the
+// pages.
+func writeSite() {
+
+	// copy theme static files first so the content directory's win
+	for _, t := range themes {
+		if static := t.Static(); static != nil {
+			err := copyFS(static, filepath.Join(cfg.OutputDir, "static"))
+			if err != nil {
+				report.Error("Error copying static files from theme", t.Name+":", err)
+			}
 		}
 	}
 
-	for _, page := range nonCollectionPages {
-		buildNonCollectionPage(page)
+	// using os.Read and os.Write copy files from contentdir/static/ to outputdir/static/
+	walkAndCopyFiles(cfg.ContentDir, cfg.OutputDir)
+
+	// make outputdir/css if it doesn't exist
+	primeDirectory(filepath.Join(cfg.OutputDir, "css"))
+
+	// render css from template and write to outputdir/css/style.css
+	wr, err := os.Create(cfg.OutputDir + "/css" + "/style.css")
+	if err != nil {
+		report.Error("Error creating file:", err)
+	} else {
+		err = templates.ExecuteTemplate(wr, "styleCSS", cfg.Site)
+		if err != nil {
+			report.Error("Error executing template styleCSS:", err)
+		}
+		wr.Close()
 	}
 
-	for _, page := range collectionPages {
-		buildCollectionPage(page)
+	primeDirectory(filepath.Join(cfg.OutputDir, "js"))
+	wr, err = os.Create(filepath.Join(cfg.OutputDir, "js", "code-copy.js"))
+	if err != nil {
+		report.Error("Error creating file:", err)
+	} else {
+		err = templates.ExecuteTemplate(wr, "codeCopyJS", cfg.Site)
+		if err != nil {
+			report.Error("Error executing template codeCopyJS:", err)
+		}
+		wr.Close()
 	}
-}
 
-func basicAuthHandler(w http.ResponseWriter, r *http.Request) bool {
-	if cfg.AdminUser == "" || cfg.AdminPass == "" {
-		return true
+	if cfg.Site.Theme.SyntaxHighlight {
+		wr, err = os.Create(filepath.Join(cfg.OutputDir, "css", "syntax.css"))
+		if err != nil {
+			report.Error("Error creating file:", err)
+		} else {
+			err = writeSyntaxCSS(wr)
+			if err != nil {
+				report.Error("Error writing syntax stylesheet:", err)
+			}
+			wr.Close()
+		}
 	}
 
-	user, pass, ok := r.BasicAuth()
+	buildPages()
+}
 
-	if !ok || subtle.ConstantTimeCompare([]byte(user), []byte(cfg.AdminUser)) != 1 || subtle.ConstantTimeCompare([]byte(pass), []byte(cfg.AdminPass)) != 1 {
-		w.Header().Set("WWW-Authenticate", `Basic realm="Restricted"`)
-		w.WriteHeader(http.StatusUnauthorized)
-		w.Write([]byte("401 Unauthorized\n"))
-		return false
-	}
+// buildPages builds the pages of every language the site is published in,
+// the default language at the root and the others below their prefix.
+func buildPages() {
+	for _, lang := range languageCodes() {
+		if lang != "" {
+			log.Println("Building pages for language", lang)
+		}
+		pages := localizedPages(lang)
+		loadEntries(pages)
 
-	return true
+		nonCollectionPages := make(config.Pages)
+		collectionPages := make(config.Pages)
+
+		for _, page := range pages {
+			if page.Collection {
+				collectionPages[page.Name] = page
+			} else {
+				nonCollectionPages[page.Name] = page
+			}
+		}
+
+		for _, page := range nonCollectionPages {
+			if skipRestricted("page "+page.Name, publishedAccess(page)) {
+				continue
+			}
+			buildNonCollectionPage(page)
+		}
+
+		for _, page := range collectionPages {
+			if skipRestricted("collection "+page.Name, pageAccess(page)) {
+				continue
+			}
+			buildCollectionPage(page)
+		}
+	}
 }
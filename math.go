@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+)
+
+// maxRendered is the number of rendered formulas and diagrams kept in
+// renderedCache.
+const maxRendered = 1000
+
+// renderedCache holds the output of build-time math and diagram rendering so
+// a formula or diagram that appears on several pages is only rendered once.
+var renderedCache = struct {
+	sync.Mutex
+	m map[string]string
+}{m: make(map[string]string)}
+
+// mathFallback and mermaidFallback are set once build-time rendering
+// failed and the source was written for the browser to render instead.
+var mathFallback, mermaidFallback atomic.Bool
+
+// mathEnabled reports whether math rendering is turned on in the theme.
+func mathEnabled() bool {
+	return cfg.Site.Theme.Math == "katex" || cfg.Site.Theme.Math == "mathjax"
+}
+
+// buildTimeRender reports whether math and diagrams are rendered to HTML and
+// SVG by pubgo rather than by scripts in the browser. Only static builds do,
+// the server renders pages per request and leaves them to the browser.
+func buildTimeRender() bool {
+	return cfg.Site.Theme.MathRender == "build" && cfg.Mode == "build"
+}
+
+// clientMath reports whether pages load the math scripts, which build-time
+// rendering only needs once it fell back to the browser.
+func clientMath() bool {
+	return !buildTimeRender() || mathFallback.Load()
+}
+
+// clientMermaid does the same for the mermaid script.
+func clientMermaid() bool {
+	return !buildTimeRender() || mermaidFallback.Load()
+}
+
+// checkMath reports math settings pubgo can't honour.
+func checkMath() {
+	theme := cfg.Site.Theme
+	switch theme.Math {
+	case "", "katex", "mathjax":
+	default:
+		report.Error("Unknown math renderer", theme.Math+", use katex or mathjax")
+	}
+	switch theme.MathRender {
+	case "", "client", "build":
+	default:
+		report.Error("Unknown math_render", theme.MathRender+", use client or build")
+	}
+	if theme.MathRender == "build" && theme.Math == "mathjax" {
+		report.Error("math_render: build isn't supported with mathjax, use katex or render math in the browser")
+	}
+}
+
+// renderMath writes a math expression. Client-side rendering emits the
+// \( \) and \[ \] delimiters KaTeX and MathJax look for, build-time
+// rendering runs the katex command line tool.
+func renderMath(w io.Writer, literal []byte, display bool) {
+	if buildTimeRender() && cfg.Site.Theme.Math == "katex" {
+		args := []string{}
+		if display {
+			args = append(args, "--display-mode")
+		}
+		out, err := renderCached("katex", literal, args, func() ([]byte, error) {
+			cmd := exec.Command("katex", args...)
+			cmd.Stdin = bytes.NewReader(literal)
+			return cmd.Output()
+		})
+		if err == nil {
+			if display {
+				fmt.Fprintf(w, `<div class="math display">%s</div>`, out)
+			} else {
+				fmt.Fprintf(w, `<span class="math inline">%s</span>`, out)
+			}
+			return
+		}
+		report.Error("Error rendering math, falling back to client-side rendering:", err)
+		mathFallback.Store(true)
+	}
+
+	if display {
+		fmt.Fprintf(w, `<div class="math display">\[%s\]</div>`, html.EscapeString(string(literal)))
+	} else {
+		fmt.Fprintf(w, `<span class="math inline">\(%s\)</span>`, html.EscapeString(string(literal)))
+	}
+}
+
+// renderMermaid writes a mermaid diagram, either as source for mermaid.js or
+// as an SVG rendered with the mermaid-cli (mmdc) command.
+func renderMermaid(w io.Writer, literal []byte) {
+	if buildTimeRender() {
+		out, err := renderCached("mermaid", literal, nil, func() ([]byte, error) {
+			return runMermaidCLI(literal)
+		})
+		if err == nil {
+			fmt.Fprintf(w, `<div class="mermaid-diagram">%s</div>`, out)
+			return
+		}
+		report.Error("Error rendering mermaid diagram, falling back to client-side rendering:", err)
+		mermaidFallback.Store(true)
+	}
+
+	fmt.Fprintf(w, `<pre class="mermaid">%s</pre>`, html.EscapeString(string(literal)))
+}
+
+// runMermaidCLI renders a diagram to SVG with mmdc, which only works on files.
+func runMermaidCLI(literal []byte) ([]byte, error) {
+	dir, err := os.MkdirTemp("", "pubgo-mermaid")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	in := filepath.Join(dir, "diagram.mmd")
+	out := filepath.Join(dir, "diagram.svg")
+	err = os.WriteFile(in, literal, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	cmd := exec.Command("mmdc", "-i", in, "-o", out)
+	if msg, err := cmd.CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("%s: %s", err, msg)
+	}
+
+	return os.ReadFile(out)
+}
+
+// renderCached returns the cached output for a renderer and source, running
+// render on a miss. Once the cache is full an arbitrary entry makes room.
+func renderCached(kind string, literal []byte, args []string, render func() ([]byte, error)) (string, error) {
+	key := fmt.Sprint(kind, args, string(literal))
+
+	renderedCache.Lock()
+	out, ok := renderedCache.m[key]
+	renderedCache.Unlock()
+	if ok {
+		return out, nil
+	}
+
+	data, err := render()
+	if err != nil {
+		return "", err
+	}
+
+	renderedCache.Lock()
+	if len(renderedCache.m) >= maxRendered {
+		for k := range renderedCache.m {
+			delete(renderedCache.m, k)
+			break
+		}
+	}
+	renderedCache.m[key] = string(data)
+	renderedCache.Unlock()
+
+	return string(data), nil
+}
@@ -1,33 +1,41 @@
 package main
 
 import (
-	"html/template"
 	"log"
 	"os"
 	"path/filepath"
 
 	"pubgo/config"
 	"pubgo/content"
-
-	"github.com/gomarkdown/markdown"
 )
 
 // build non collection page
 func buildNonCollectionPage(page config.Page) {
 	log.Printf("Building page: %+v", page)
-	pageFilename := cfg.ContentDir + "/" + page.Name + ".md"
+	pageFilename, ok := localizedFile(page.Lang, page.Name+".md")
+	if unlocalizedPath(page) == "/" {
+		pageFilename, ok = localizedHome(page.Lang, page.Name+".md")
+	}
+	if !ok && page.Lang != defaultLanguage() {
+		log.Printf("Skipping page %s, it isn't translated to %s", page.Name, page.Lang)
+		return
+	}
 	md, err := os.ReadFile(pageFilename)
 	var entry content.Entry
 
 	if err != nil {
-		log.Println("Error reading markdown file:", err)
+		report.Error("Error reading markdown file:", err)
+		return
 	}
 
-	entry, md, _ = content.ParseEntry(md)
+	entry, md, err = content.ParseEntry(md)
+	if err != nil && err != content.ErrNoFrontMatter {
+		report.Error("Error parsing front matter", pageFilename+":", err)
+	}
 
 	var title string
-	if page.Path == "/" {
-		title = cfg.Site.Name + " ~ " + cfg.Site.Title
+	if unlocalizedPath(page) == "/" {
+		title = cfg.Site.Name + " ~ " + localizedSite(page.Lang).Title
 	} else {
 		if entry.Title != "" {
 			title = cfg.Site.Name + " ~ " + entry.Title
@@ -36,9 +44,11 @@ func buildNonCollectionPage(page config.Page) {
 		}
 	}
 
-	renderer, p := newCustomizedRender(entry.IncludeToc, cfg.Site.Theme.SyntaxHighlight)
+	entry.Body, err = renderMarkdown(md, entry.IncludeToc)
+	if err != nil {
+		report.Error("Error rendering page", page.Name+":", err)
+	}
 
-	entry.Body = template.HTML(markdown.ToHTML(md, p, renderer))
 	cont := content.Content{
 		Site:        cfg.Site,
 		Page:        page,
@@ -49,24 +59,31 @@ func buildNonCollectionPage(page config.Page) {
 		Collection:  page.Collection,
 		Entry:       entry,
 	}
+	localizeContent(&cont)
 
 	primeDirectory(filepath.Join(cfg.OutputDir, page.Path))
 
 	// file writer for index.html
 	wr, err := os.Create(cfg.OutputDir + page.Path + "/index.html")
 	if err != nil {
-		log.Println("Error creating file:", err)
+		report.Error("Error creating file:", err)
+		return
 	}
+	defer wr.Close()
 
-	err = templates.ExecuteTemplate(wr, "indexHTML", cont)
+	err = templates.ExecuteTemplate(wr, layoutTemplate(entry.Layout, page.Layout), cont)
 	if err != nil {
-		log.Println("Error executing template:", err)
+		report.Error("Error executing template for page", page.Name+":", err)
 	}
 }
 
 func loadSingleEntry(page config.Page) {
 	// Get markdown file
-	data, err := os.ReadFile(filepath.Join(cfg.ContentDir, page.Name+".md"))
+	file, ok := localizedFile(page.Lang, page.Name+".md")
+	if !ok && page.Lang != defaultLanguage() {
+		return
+	}
+	data, err := os.ReadFile(file)
 
 	// if file doesn't exist, create it with default content
 	if os.IsNotExist(err) {
@@ -78,6 +95,9 @@ func loadSingleEntry(page config.Page) {
 		}
 	}
 
-	entry := createEntry(page, "", page.Name+".md", data)
+	entry, ok := createEntry(page, "", page.Name+".md", data)
+	if !ok {
+		return
+	}
 	entries[page.Name] = append(entries[page.Name], entry)
 }
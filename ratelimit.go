@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// rateLimiter allows up to limit events per key, such as a client's address,
+// within a sliding window.
+type rateLimiter struct {
+	sync.Mutex
+	limit  int
+	window time.Duration
+	events map[string][]time.Time
+}
+
+func newRateLimiter(limit int, window time.Duration) *rateLimiter {
+	return &rateLimiter{
+		limit:  limit,
+		window: window,
+		events: make(map[string][]time.Time),
+	}
+}
+
+// Allow records an event for key and reports whether it is within the
+// limit. A limit of 0 or less allows everything.
+func (l *rateLimiter) Allow(key string) bool {
+	if l.limit <= 0 {
+		return true
+	}
+
+	l.Lock()
+	defer l.Unlock()
+
+	now := time.Now()
+	recent := l.recent(key, now)
+	if len(recent) >= l.limit {
+		l.events[key] = recent
+		return false
+	}
+	l.events[key] = append(recent, now)
+
+	// forget clients that have gone quiet so the map doesn't keep growing
+	if len(l.events) > 10000 {
+		for k := range l.events {
+			if len(l.recent(k, now)) == 0 {
+				delete(l.events, k)
+			}
+		}
+	}
+	return true
+}
+
+// recent returns the events of key within the window.
+func (l *rateLimiter) recent(key string, now time.Time) []time.Time {
+	events := l.events[key]
+	for len(events) > 0 && now.Sub(events[0]) >= l.window {
+		events = events[1:]
+	}
+	return events
+}
+
+// clientIP returns the address a request came from, without its port.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+)
+
+// buildReport collects the errors and warnings raised while loading and
+// building the site so they can be summarised once the build is done.
+// While serving, errors come up per request and are only logged, unless
+// they are being collected.
+type buildReport struct {
+	mu         sync.Mutex
+	errors     []string
+	warnings   []string
+	collecting bool
+}
+
+var report buildReport
+
+// recording reports whether messages are kept. The caller holds mu.
+func (r *buildReport) recording() bool {
+	return cfg.Mode != "serve" || r.collecting
+}
+
+// Error logs and records an error. Arguments are handled like log.Println.
+func (r *buildReport) Error(v ...interface{}) {
+	log.Println(v...)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.recording() {
+		r.errors = append(r.errors, strings.TrimSuffix(fmt.Sprintln(v...), "\n"))
+	}
+}
+
+// Warn logs and records a warning. Arguments are handled like log.Println.
+func (r *buildReport) Warn(v ...interface{}) {
+	log.Println(v...)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.recording() {
+		r.warnings = append(r.warnings, strings.TrimSuffix(fmt.Sprintln(v...), "\n"))
+	}
+}
+
+// Failed reports whether any errors were recorded.
+func (r *buildReport) Failed() bool {
+	return r.ErrorCount() > 0
+}
+
+// ErrorCount returns the number of errors recorded.
+func (r *buildReport) ErrorCount() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.errors)
+}
+
+// Collect runs f and returns the errors and warnings reported meanwhile,
+// also while serving, leaving them out of the report.
+func (r *buildReport) Collect(f func()) (errors, warnings []string) {
+	r.mu.Lock()
+	savedErrors, savedWarnings, saved := r.errors, r.warnings, r.collecting
+	r.errors, r.warnings, r.collecting = nil, nil, true
+	r.mu.Unlock()
+
+	f()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	errors, warnings = r.errors, r.warnings
+	r.errors, r.warnings, r.collecting = savedErrors, savedWarnings, saved
+	return errors, warnings
+}
+
+// buildSummary is the outcome of a build as written with -summary.
+type buildSummary struct {
+	Errors   []string `json:"errors"`
+	Warnings []string `json:"warnings"`
+}
+
+// WriteSummary writes the recorded errors and warnings to file as JSON, for
+// the server to read back after rebuilding the site.
+func (r *buildReport) WriteSummary(file string) error {
+	r.mu.Lock()
+	data, err := json.Marshal(buildSummary{Errors: r.errors, Warnings: r.warnings})
+	r.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(file, data, 0644)
+}
+
+// Summary logs every recorded error and warning followed by the totals.
+func (r *buildReport) Summary() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, msg := range r.warnings {
+		log.Println("WARNING:", msg)
+	}
+	for _, msg := range r.errors {
+		log.Println("ERROR:", msg)
+	}
+	log.Printf("Finished with %d error(s) and %d warning(s)", len(r.errors), len(r.warnings))
+}
@@ -3,16 +3,15 @@ package main
 import (
 	"fmt"
 	"html/template"
-	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
+	"path"
 	"path/filepath"
 	"pubgo/config"
 	"pubgo/content"
 	"strings"
-
-	"github.com/gomarkdown/markdown"
+	"time"
 )
 
 var fourOhFour = `
@@ -31,22 +30,29 @@ var fourOhFour = `
 
 // setup main router
 func setupRouter() {
+	setupAdminRoutes()
+	setupEditorRoutes()
+	setupDeployRoutes()
+	setupCommentRoutes()
+	setupFormRoutes()
+
+	accessLimiter = newRateLimiter(cfg.Admin.LoginRateLimit, 15*time.Minute)
+
 	// a handler to process the request path and map it to a page
-	http.HandleFunc("/admin", func(w http.ResponseWriter, r *http.Request) {
+	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		logRequest(r)
-		authed := basicAuthHandler(w, r)
-		if !authed {
+		lang, path := splitLanguage(r.URL.Path)
+
+		if cfg.Site.SocialCards && filepath.Ext(path) == ".png" && serveSocialCard(w, r) {
 			return
-		} else {
-			fmt.Fprintln(w, "Admin handler")
+		}
+
+		if privatePath(path) {
+			handleNotFoundError(w, r)
 			return
 		}
-	})
 
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		logRequest(r)
-		path := r.URL.Path
-		route, err := parseRoute(path)
+		route, err := parseRoute(path, lang)
 
 		log.Printf("Route: %s, Error: %s\n", route, err)
 
@@ -55,10 +61,14 @@ func setupRouter() {
 			return
 		}
 
+		if !allowAccess(w, r, routeAccess(path, lang, route)) {
+			return
+		}
+
 		// if route is not a directory
 		if !isDir(route) {
-			if isSinglePage(route) {
-				renderSinglePage(w, path, route)
+			if isSinglePage(path) {
+				renderSinglePage(w, r, route)
 				return
 			} else {
 				renderEntryPage(w, r, route)
@@ -71,26 +81,29 @@ func setupRouter() {
 	})
 }
 
+// isSinglePage reports whether a request path, without its language
+// prefix, is that of a page rather than an entry of a collection.
 func isSinglePage(path string) bool {
-	contentDir := cfg.ContentDir
-
-	// if cfg.ContentDir has "./" prefix then remove it
-	if strings.HasPrefix(contentDir, "./") {
-		contentDir = strings.TrimPrefix(contentDir, "./")
-	}
-
-	// remove contentDir from path
-	path = strings.TrimPrefix(path, contentDir)
-	fileParts := strings.Split(path, string(os.PathSeparator))
+	fileParts := strings.Split(strings.TrimPrefix(path, "/"), "/")
 
 	log.Printf("Path: %s, FileParts: %s\n", path, fileParts)
-	if len(fileParts) > 2 {
-		if isDir(filepath.Join(cfg.ContentDir, fileParts[0])) {
-			return false
+	return len(fileParts) < 2
+}
+
+// privatePath reports whether a request path points into a part of the
+// content directory that isn't published, like the git repository or the
+// comments and form submissions sent in by visitors.
+func privatePath(path string) bool {
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	if parts[0] == "comments" || parts[0] == "forms" {
+		return true
+	}
+	for _, part := range parts {
+		if strings.HasPrefix(part, ".") {
+			return true
 		}
-		return false
 	}
-	return true
+	return false
 }
 
 func isDir(path string) bool {
@@ -105,23 +118,25 @@ func isRootPath(path string) bool {
 	return path == "/" || path == "" || path == "/index.html" || path == "/index"
 }
 
-func parseRoute(path string) (string, error) {
+// parseRoute maps a request path, without its language prefix, to the file
+// in the content directory holding its lang version.
+func parseRoute(path string, lang string) (string, error) {
 	// if the path is "/" or "/index.html" then use the home page
 	if isRootPath(path) {
-		if _, err := os.Stat(filepath.Join(cfg.ContentDir, "home.md")); err == nil {
-			return filepath.Join(cfg.ContentDir, "home.md"), nil
+		if file, ok := localizedHome(lang, "home.md"); ok {
+			return file, nil
 		} else {
-			return "", err
+			return "", fmt.Errorf("Route not found")
 		}
 	}
 
 	// if the path doesn't have an extension then it's a page
 	if filepath.Ext(path) == "" {
 		// if path + ".md" exists then use it
-		if _, err := os.Stat(filepath.Join(cfg.ContentDir, path+".md")); err == nil {
-			return filepath.Join(cfg.ContentDir, path+".md"), nil
-		} else if _, err := os.Stat(filepath.Join(cfg.ContentDir, path)); err == nil {
-			return filepath.Join(cfg.ContentDir, path), nil
+		if file, ok := localizedFile(lang, path+".md"); ok {
+			return file, nil
+		} else if _, err := os.Stat(filepath.Join(languageRoot(lang), path)); err == nil {
+			return filepath.Join(languageRoot(lang), path), nil
 		}
 	}
 
@@ -130,8 +145,8 @@ func parseRoute(path string) (string, error) {
 		// if html lookup md file
 		if filepath.Ext(path) == ".html" {
 			path = strings.TrimSuffix(path, filepath.Ext(path))
-			if _, err := os.Stat(filepath.Join(cfg.ContentDir, path+".md")); err == nil {
-				return filepath.Join(cfg.ContentDir, path+".md"), nil
+			if file, ok := localizedFile(lang, path+".md"); ok {
+				return file, nil
 			}
 		} else if _, err := os.Stat(filepath.Join(cfg.ContentDir, path)); err == nil {
 			return filepath.Join(cfg.ContentDir, path), nil
@@ -141,8 +156,40 @@ func parseRoute(path string) (string, error) {
 	return "", fmt.Errorf("Route not found")
 }
 
+// layoutTemplate returns the template to render a page with, taken from the
+// first known layout. A layout is either a template name or its short form
+// without the HTML suffix, e.g. "docs" for docsHTML. Unknown layouts are
+// reported, falls back to indexHTML.
+func layoutTemplate(layouts ...string) string {
+	for _, layout := range layouts {
+		if layout == "" {
+			continue
+		}
+		for _, name := range []string{layout + "HTML", layout} {
+			if pageTemplates[name] {
+				return name
+			}
+		}
+		reportUnknownLayout(layout)
+	}
+	return "indexHTML"
+}
+
+// reportUnknownLayout reports a layout naming no template in a layouts
+// directory, once until the templates are loaded again.
+func reportUnknownLayout(layout string) {
+	unknownLayouts.Lock()
+	reported := unknownLayouts.m[layout]
+	unknownLayouts.m[layout] = true
+	unknownLayouts.Unlock()
+	if !reported {
+		report.Error("Unknown layout", layout+", falling back to indexHTML")
+	}
+}
+
 // handleNotFoundError handles the request for a non-existing route
 func handleNotFoundError(w http.ResponseWriter, r *http.Request) {
+	lang, _ := splitLanguage(r.URL.Path)
 	cont := content.Content{
 		Site:        cfg.Site,
 		RequestPath: r.URL.Path,
@@ -153,16 +200,15 @@ func handleNotFoundError(w http.ResponseWriter, r *http.Request) {
 			Title: "404",
 			Body:  template.HTML(fourOhFour),
 		},
+		Page: config.Page{Lang: lang},
 	}
-	w.WriteHeader(http.StatusNotFound)
-	err := templates.ExecuteTemplate(w, "indexHTML", cont)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-	}
+	localizeContent(&cont)
+	executeTemplate(w, http.StatusNotFound, "indexHTML", cont)
 }
 
 // renderSinglePage renders a single page (Markdown or HTML) to the response writer
-func renderSinglePage(w http.ResponseWriter, requestPath string, filePath string) {
+func renderSinglePage(w http.ResponseWriter, r *http.Request, filePath string) {
+	lang, requestPath := splitLanguage(r.URL.Path)
 	pages := cfg.Site.Pages
 	var page config.Page
 	for _, p := range pages {
@@ -170,6 +216,7 @@ func renderSinglePage(w http.ResponseWriter, requestPath string, filePath string
 			page = p
 		}
 	}
+	page = localizePage(page, lang)
 
 	log.Printf("Page: %+v\n", page)
 	md, err := os.ReadFile(filePath)
@@ -185,7 +232,7 @@ func renderSinglePage(w http.ResponseWriter, requestPath string, filePath string
 	var title string
 
 	if requestPath == "/" {
-		title = cfg.Site.Name + " ~ " + cfg.Site.Title
+		title = cfg.Site.Name + " ~ " + localizedSite(lang).Title
 	} else {
 		if entry.Title != "" {
 			title = cfg.Site.Name + " ~ " + entry.Title
@@ -194,27 +241,37 @@ func renderSinglePage(w http.ResponseWriter, requestPath string, filePath string
 		}
 	}
 
-	renderer, p := newCustomizedRender(entry.IncludeToc, cfg.Site.Theme.SyntaxHighlight)
-	entry.Body = template.HTML(markdown.ToHTML(md, p, renderer))
+	entry.Body, err = renderMarkdown(md, entry.IncludeToc)
+	if err != nil {
+		log.Println("Error rendering markdown:", err)
+	}
 	cont := content.Content{
 		Site:        cfg.Site,
 		Page:        page,
-		RequestPath: requestPath,
+		RequestPath: r.URL.Path,
 		Mode:        cfg.Mode,
 		Title:       title,
 		Collection:  page.Collection,
 		Entry:       entry,
 	}
+	localizeContent(&cont)
 
-	err = templates.ExecuteTemplate(w, "indexHTML", cont)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-	}
+	executeTemplate(w, 0, layoutTemplate(entry.Layout, page.Layout), cont)
 }
 
 // renderEntryPage renders an entry page (Markdown or HTML) to the response writer
 func renderEntryPage(w http.ResponseWriter, r *http.Request, filePath string) {
-	collection := filepath.Base(filepath.Dir(filePath))
+	renderEntry(w, r, filePath, "")
+}
+
+// renderEntry renders an entry page with its comment section, rendered
+// by the comments provider unless given.
+func renderEntry(w http.ResponseWriter, r *http.Request, filePath string, commentSection template.HTML) {
+	// the collection is the first directory of the path, entries of docs
+	// collections may be further down
+	lang, rel := splitLanguage(r.URL.Path)
+	parts := strings.SplitN(strings.TrimPrefix(rel, "/"), "/", 2)
+	collection := parts[0]
 	collections := cfg.Site.Pages
 	var page config.Page
 	for _, c := range collections {
@@ -222,6 +279,7 @@ func renderEntryPage(w http.ResponseWriter, r *http.Request, filePath string) {
 			page = c
 		}
 	}
+	page = localizePage(page, lang)
 
 	md, err := os.ReadFile(filePath)
 	entry := content.Entry{}
@@ -233,6 +291,8 @@ func renderEntryPage(w http.ResponseWriter, r *http.Request, filePath string) {
 	}
 
 	entry, md, _ = content.ParseEntry(md)
+	entry.FileName = strings.TrimSuffix(parts[1], ".html") + ".html"
+	entry.Page = path.Join(strings.TrimPrefix(languagePrefix(lang), "/"), page.Name)
 	var title string
 
 	if entry.Title != "" {
@@ -241,8 +301,10 @@ func renderEntryPage(w http.ResponseWriter, r *http.Request, filePath string) {
 		title = cfg.Site.Name + " ~ " + page.Name
 	}
 
-	renderer, p := newCustomizedRender(entry.IncludeToc, cfg.Site.Theme.SyntaxHighlight)
-	entry.Body = template.HTML(markdown.ToHTML(md, p, renderer))
+	entry.Body, err = renderMarkdown(md, entry.IncludeToc)
+	if err != nil {
+		log.Println("Error rendering markdown:", err)
+	}
 	cont := content.Content{
 		Site:        cfg.Site,
 		RequestPath: r.URL.Path,
@@ -250,60 +312,44 @@ func renderEntryPage(w http.ResponseWriter, r *http.Request, filePath string) {
 		Title:       title,
 		Page:        page,
 		Entry:       entry,
+		Comments:    commentSection,
 	}
+	setEntryNavigation(&cont, collectionEntries(page))
+	localizeContent(&cont)
 	if r.Header.Get("HX-Request") == "true" {
 		cont.Title = cfg.Site.Name + " ~ " + r.URL.Path
 
-		err := templates.ExecuteTemplate(w, "entryHTML", cont)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
+		executeTemplate(w, 0, "entryHTML", cont)
 	} else {
 		cont.Title = cfg.Site.Name + " - " + entry.Title
 
-		err := templates.ExecuteTemplate(w, "indexHTML", cont)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-		}
+		executeTemplate(w, 0, layoutTemplate(entry.Layout, page.Layout), cont)
 	}
 
 }
 
 // renderEntriesPage renders an entries page (Markdown or HTML) to the response writer
 func renderEntriesPage(w http.ResponseWriter, r *http.Request, filePath string) {
+	lang, requestPath := splitLanguage(r.URL.Path)
 	pages := cfg.Site.Pages
 
 	var page config.Page
 	for _, p := range pages {
-		if p.Path == r.URL.Path || p.Path+"/" == r.URL.Path {
+		if p.Path == requestPath || p.Path+"/" == requestPath {
 			page = p
 		}
 	}
+	page = localizePage(page, lang)
 
-	files, _ := ioutil.ReadDir(filePath)
-	var ents []content.Entry
-	for _, f := range files {
-		log.Printf("File: %s/%s\n", filePath, f.Name())
-		filename := f.Name()
-
-		if filepath.Ext(f.Name()) == ".md" {
-			data, err := os.ReadFile(filepath.Join(filePath, f.Name()))
-
-			if err != nil {
-				http.Error(w, "Error reading markdown file: "+err.Error(), http.StatusInternalServerError)
-				log.Println("Error reading markdown file:", err)
-				return
-			}
-			entry := createEntry(page, page.Name, filename, data)
-			ents = append(ents, entry)
-		}
+	// directories that aren't collections, like those nested in a docs
+	// collection, have no page of their own
+	if page.Name == "" || !page.Collection {
+		handleNotFoundError(w, r)
+		return
 	}
 
+	ents := collectionEntries(page)
 	cont := createContent(page, ents)
-	err := templates.ExecuteTemplate(w, "indexHTML", cont)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-	}
+	executeTemplate(w, 0, layoutTemplate(page.Layout), cont)
 
 }
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// sessionCookie holds the id of a signed in user's session.
+const sessionCookie = "pubgo_session"
+
+// session is a signed in user. Sessions are kept in memory, so everyone
+// has to sign in again after a restart.
+type session struct {
+	ID      string
+	User    string
+	Expires time.Time
+}
+
+// sessionStore keeps the sessions by id.
+type sessionStore struct {
+	sync.Mutex
+	sessions map[string]session
+}
+
+var sessions = &sessionStore{sessions: make(map[string]session)}
+
+// Create starts a session for user.
+func (s *sessionStore) Create(user string) session {
+	s.Lock()
+	defer s.Unlock()
+
+	now := time.Now()
+	for id, sess := range s.sessions {
+		if now.After(sess.Expires) {
+			delete(s.sessions, id)
+		}
+	}
+
+	sess := session{
+		ID:      randomID(32),
+		User:    user,
+		Expires: now.Add(time.Duration(cfg.Admin.SessionHours) * time.Hour),
+	}
+	s.sessions[sess.ID] = sess
+	return sess
+}
+
+// Get returns the unexpired session id.
+func (s *sessionStore) Get(id string) (session, bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	sess, ok := s.sessions[id]
+	if !ok || time.Now().After(sess.Expires) {
+		delete(s.sessions, id)
+		return session{}, false
+	}
+	return sess, true
+}
+
+// Delete ends the session id.
+func (s *sessionStore) Delete(id string) {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.sessions, id)
+}
+
+// currentUser returns the signed in user of a request and their session.
+// Users removed from the users file lose access right away.
+func currentUser(r *http.Request) (User, session, bool) {
+	c, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return User{}, session{}, false
+	}
+	sess, ok := sessions.Get(c.Value)
+	if !ok {
+		return User{}, session{}, false
+	}
+	user, ok := findUser(sess.User)
+	if !ok {
+		return User{}, session{}, false
+	}
+	return user, sess, true
+}
+
+// setSessionCookie hands the browser the cookie of sess, or removes it
+// when sess is empty.
+func setSessionCookie(w http.ResponseWriter, r *http.Request, sess session) {
+	c := &http.Cookie{
+		Name:     sessionCookie,
+		Value:    sess.ID,
+		Path:     "/",
+		Expires:  sess.Expires,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	}
+	if sess.ID == "" {
+		c.MaxAge = -1
+	}
+	http.SetCookie(w, c)
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"pubgo/config"
+
+	"github.com/gomarkdown/markdown"
+)
+
+// maxIncludeDepth limits how deeply include shortcodes may nest.
+const maxIncludeDepth = 10
+
+var (
+	// shortcodePattern matches {{< name params >}}, {{< /name >}} and the
+	// escaped form {{</* name params */>}}, which is output literally.
+	shortcodePattern = regexp.MustCompile(`\{\{<\s*(/\*)?\s*(/)?([a-zA-Z][\w-]*)(.*?)(\*/)?\s*>\}\}`)
+	paramPattern     = regexp.MustCompile(`([\w-]+)=(?:"([^"]*)"|'([^']*)'|(\S+))|"([^"]*)"|'([^']*)'|(\S+)`)
+	shortcodes       *template.Template
+)
+
+// Shortcode is the data passed to a shortcode template.
+type Shortcode struct {
+	Name    string
+	Params  map[string]string
+	Inner   template.HTML
+	Ordinal int
+	Index   int
+	Parent  *Shortcode
+	Site    config.Site
+	// Mode is the mode pubgo runs in, e.g. build for static builds.
+	Mode string
+
+	children int
+}
+
+// Get returns a named parameter, or a positional one when given its index
+// ("0", "1", ...).
+func (s *Shortcode) Get(key string) string {
+	return s.Params[key]
+}
+
+// loadShortcodes parses the embedded shortcode templates, those of the
+// installed themes and any user templates in
+// <content_dir>/templates/shortcodes, each taking precedence over the last.
+// Each file defines the shortcode named after the file, e.g. figure.html.tmpl
+// defines figure.
+func loadShortcodes() {
+	shortcodes = template.New("").Funcs(templateFuncs())
+
+	files, err := fs.Glob(templateFiles, "templates/shortcodes/*.tmpl")
+	if err != nil {
+		log.Println("Error listing shortcode templates:", err)
+	}
+	for _, file := range files {
+		data, err := templateFiles.ReadFile(file)
+		if err != nil {
+			report.Error("Error reading shortcode template:", err)
+			continue
+		}
+		addShortcode("embedded", file, data)
+	}
+
+	for _, t := range themes {
+		for _, file := range t.Glob("templates/shortcodes/*.tmpl") {
+			data, err := fs.ReadFile(t.FS, file)
+			if err != nil {
+				report.Error("Error reading shortcode template:", err)
+				continue
+			}
+			addShortcode("theme "+t.Name, filepath.Join("themes", t.Name, file), data)
+		}
+	}
+
+	customDir := filepath.Join(cfg.ContentDir, "templates", "shortcodes")
+	files, _ = filepath.Glob(filepath.Join(customDir, "*.tmpl"))
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			report.Error("Error reading shortcode template:", err)
+			continue
+		}
+		log.Println("Found custom shortcode:", filepath.Base(file))
+		addShortcode("custom", file, data)
+	}
+}
+
+// addShortcode parses a shortcode template, replacing any previous
+// definition of the same name.
+func addShortcode(origin, file string, data []byte) {
+	name := strings.SplitN(filepath.Base(file), ".", 2)[0]
+	_, err := shortcodes.New(name).Parse(string(data))
+	if err != nil {
+		report.Error("Error parsing shortcode template", file+":", err)
+		return
+	}
+	templateSources[file] = templateSource{Origin: origin, File: file, Data: data}
+	shortcodeProviders[name] = append(shortcodeProviders[name], file)
+}
+
+// renderMarkdown expands shortcodes in md and renders the result to HTML.
+// Errors in individual shortcodes are returned after rendering the rest of
+// the document, with the failing shortcode left out.
+func renderMarkdown(md []byte, toc bool) (template.HTML, error) {
+	e := &shortcodeExpander{}
+	html := e.render(md, toc)
+	if len(e.errs) > 0 {
+		return html, fmt.Errorf("shortcodes: %s", strings.Join(e.errs, "; "))
+	}
+	return html, nil
+}
+
+// shortcodeExpander replaces shortcodes with placeholders before markdown is
+// rendered and swaps the placeholders for the shortcode output afterwards,
+// so the markdown renderer never touches shortcode HTML.
+type shortcodeExpander struct {
+	count int
+	depth int
+	stack []*Shortcode
+	errs  []string
+}
+
+func (e *shortcodeExpander) render(md []byte, toc bool) template.HTML {
+	src, holders := e.expand(md)
+	src = normalizeFenceInfo(src)
+
+	renderer, p := newCustomizedRender(toc, cfg.Site.Theme.SyntaxHighlight)
+	html := markdown.ToHTML(src, p, renderer)
+
+	for placeholder, out := range holders {
+		html = bytes.Replace(html, []byte("<p>"+placeholder+"</p>"), out, -1)
+		html = bytes.Replace(html, []byte(placeholder), out, -1)
+	}
+
+	return template.HTML(html)
+}
+
+// expand replaces every shortcode in md with a placeholder and returns the
+// rewritten source along with the output for each placeholder.
+func (e *shortcodeExpander) expand(md []byte) ([]byte, map[string][]byte) {
+	holders := make(map[string][]byte)
+	var out bytes.Buffer
+
+	pos := 0
+	for {
+		loc := shortcodePattern.FindSubmatchIndex(md[pos:])
+		if loc == nil {
+			out.Write(md[pos:])
+			break
+		}
+		for i := range loc {
+			if loc[i] >= 0 {
+				loc[i] += pos
+			}
+		}
+
+		start, end := loc[0], loc[1]
+		out.Write(md[pos:start])
+		pos = end
+
+		// escaped shortcode, output it without the comment markers
+		if loc[2] >= 0 {
+			tag := string(md[start:end])
+			tag = strings.Replace(tag, "/*", "", 1)
+			tag = strings.Replace(tag, "*/", "", 1)
+			out.WriteString(tag)
+			continue
+		}
+
+		name := string(md[loc[6]:loc[7]])
+		if loc[4] >= 0 {
+			e.errs = append(e.errs, fmt.Sprintf("unexpected closing shortcode %q", name))
+			continue
+		}
+
+		params := strings.TrimSpace(string(md[loc[8]:loc[9]]))
+		params = strings.TrimSpace(strings.TrimSuffix(params, "/"))
+
+		if name == "include" {
+			src, included := e.include(parseShortcodeParams(params))
+			for placeholder, html := range included {
+				holders[placeholder] = html
+			}
+			out.Write(src)
+			continue
+		}
+
+		var inner []byte
+		if closeStart, closeEnd := findClosingShortcode(md, end, name); closeStart >= 0 {
+			inner = md[end:closeStart]
+			pos = closeEnd
+		}
+
+		html := e.execute(name, parseShortcodeParams(params), inner)
+
+		placeholder := fmt.Sprintf("pubgo-shortcode-%d-", e.count)
+		e.count++
+		holders[placeholder] = html
+
+		// a shortcode on a line of its own is block level, keep the
+		// markdown renderer from wrapping it in a paragraph with other text
+		if isLineStart(md, start) && isLineEnd(md, pos) {
+			out.WriteString("\n\n" + placeholder + "\n\n")
+		} else {
+			out.WriteString(placeholder)
+		}
+	}
+
+	return out.Bytes(), holders
+}
+
+// execute renders a single shortcode. Inner content is rendered as markdown
+// before being passed to the template.
+func (e *shortcodeExpander) execute(name string, params map[string]string, inner []byte) []byte {
+	tmpl := shortcodes.Lookup(name)
+	if tmpl == nil {
+		e.errs = append(e.errs, fmt.Sprintf("unknown shortcode %q", name))
+		return nil
+	}
+
+	sc := &Shortcode{
+		Name:    name,
+		Params:  params,
+		Ordinal: e.count,
+		Site:    cfg.Site,
+		Mode:    cfg.Mode,
+	}
+	e.count++
+	if len(e.stack) > 0 {
+		sc.Parent = e.stack[len(e.stack)-1]
+		sc.Index = sc.Parent.children
+		sc.Parent.children++
+	}
+
+	if inner != nil {
+		e.stack = append(e.stack, sc)
+		sc.Inner = e.render(inner, false)
+		e.stack = e.stack[:len(e.stack)-1]
+	}
+
+	var buf bytes.Buffer
+	err := tmpl.Execute(&buf, sc)
+	if err != nil {
+		e.errs = append(e.errs, fmt.Sprintf("shortcode %q: %s", name, err))
+		return nil
+	}
+
+	return buf.Bytes()
+}
+
+// include expands the contents of a file in the content directory so it can
+// be spliced into the including document along with its placeholders.
+func (e *shortcodeExpander) include(params map[string]string) ([]byte, map[string][]byte) {
+	file := params["file"]
+	if file == "" {
+		file = params["0"]
+	}
+
+	if e.depth >= maxIncludeDepth {
+		e.errs = append(e.errs, fmt.Sprintf("include %q: too many nested includes", file))
+		return nil, nil
+	}
+
+	data, err := os.ReadFile(filepath.Join(cfg.ContentDir, filepath.Clean("/"+file)))
+	if err != nil {
+		e.errs = append(e.errs, fmt.Sprintf("include %q: %s", file, err))
+		return nil, nil
+	}
+
+	e.depth++
+	defer func() { e.depth-- }()
+
+	return e.expand(data)
+}
+
+// findClosingShortcode returns the position of the {{< /name >}} matching an
+// opening shortcode that ended at from, or -1 if the shortcode is not paired.
+func findClosingShortcode(md []byte, from int, name string) (int, int) {
+	depth := 1
+	pos := from
+	for {
+		loc := shortcodePattern.FindSubmatchIndex(md[pos:])
+		if loc == nil {
+			return -1, -1
+		}
+		start, end := pos+loc[0], pos+loc[1]
+		pos = end
+
+		if loc[2] >= 0 || string(md[start+loc[6]-loc[0]:start+loc[7]-loc[0]]) != name {
+			continue
+		}
+		if loc[4] >= 0 {
+			depth--
+			if depth == 0 {
+				return start, end
+			}
+		} else {
+			depth++
+		}
+	}
+}
+
+// parseShortcodeParams parses key="value" pairs. Positional values are
+// stored under their index.
+func parseShortcodeParams(s string) map[string]string {
+	params := make(map[string]string)
+	position := 0
+	for _, m := range paramPattern.FindAllStringSubmatch(s, -1) {
+		if m[1] != "" {
+			params[m[1]] = m[2] + m[3] + m[4]
+			continue
+		}
+		params[strconv.Itoa(position)] = m[5] + m[6] + m[7]
+		position++
+	}
+	return params
+}
+
+func isLineStart(md []byte, pos int) bool {
+	i := bytes.LastIndexByte(md[:pos], '\n')
+	return len(bytes.TrimSpace(md[i+1:pos])) == 0
+}
+
+func isLineEnd(md []byte, pos int) bool {
+	i := bytes.IndexByte(md[pos:], '\n')
+	if i < 0 {
+		i = len(md) - pos
+	}
+	return len(bytes.TrimSpace(md[pos:pos+i])) == 0
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	_ "image/gif"
+	_ "image/jpeg"
+	"image/png"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"pubgo/config"
+	"pubgo/content"
+
+	xdraw "golang.org/x/image/draw"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/gobold"
+	"golang.org/x/image/font/gofont/goregular"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/math/fixed"
+)
+
+const (
+	cardWidth    = 1200
+	cardHeight   = 630
+	cardMargin   = 80
+	cardMaxLines = 4
+)
+
+var (
+	cardFonts struct {
+		sync.Once
+		bold, regular *opentype.Font
+		err           error
+	}
+
+	// cardCache holds the cards rendered in serve mode, keyed by the
+	// entry's file and invalidated when it changes.
+	cardCache = struct {
+		sync.Mutex
+		m map[string]renderedCard
+	}{m: make(map[string]renderedCard)}
+)
+
+type renderedCard struct {
+	modTime time.Time
+	data    []byte
+}
+
+// cardFileName returns the file name of an entry's social card, written
+// next to its page.
+func cardFileName(entry content.Entry) string {
+	return strings.TrimSuffix(entry.StaticFileName(), ".html") + ".png"
+}
+
+// renderSocialCard draws the social preview image of an entry: its title,
+// date and author along with the site's logo and name, in the theme colors.
+func renderSocialCard(w io.Writer, entry content.Entry) error {
+	cardFonts.Do(func() {
+		cardFonts.bold, cardFonts.err = opentype.Parse(gobold.TTF)
+		if cardFonts.err == nil {
+			cardFonts.regular, cardFonts.err = opentype.Parse(goregular.TTF)
+		}
+	})
+	if cardFonts.err != nil {
+		return cardFonts.err
+	}
+
+	theme := cfg.Site.Theme
+	bg := parseColor(theme.Bg, color.RGBA{0xf8, 0xfa, 0xfb, 0xff})
+	fg := parseColor(theme.Fg, color.RGBA{0x02, 0x02, 0x02, 0xff})
+	accent := parseColor(theme.Accent, fg)
+	muted := parseColor(theme.MutedAccent, fg)
+
+	img := image.NewRGBA(image.Rect(0, 0, cardWidth, cardHeight))
+	draw.Draw(img, img.Bounds(), image.NewUniform(bg), image.Point{}, draw.Src)
+	draw.Draw(img, image.Rect(0, cardHeight-16, cardWidth, cardHeight), image.NewUniform(accent), image.Point{}, draw.Src)
+
+	// site logo and name along the top
+	x := cardMargin
+	if logo := loadCardLogo(cfg.Site.Logo); logo != nil {
+		size := 80
+		b := logo.Bounds()
+		width := b.Dx() * size / b.Dy()
+		xdraw.CatmullRom.Scale(img, image.Rect(x, cardMargin, x+width, cardMargin+size), logo, b, xdraw.Over, nil)
+		x += width + 24
+	}
+	name := cfg.Site.LogoText
+	if name == "" {
+		name = cfg.Site.Name
+	}
+	face, err := cardFace(cardFonts.bold, 40)
+	if err != nil {
+		return err
+	}
+	drawText(img, face, fg, x, cardMargin+54, name)
+
+	// the title, made smaller when it needs more lines
+	var lines []string
+	for _, size := range []float64{72, 60, 50} {
+		face, err = cardFace(cardFonts.bold, size)
+		if err != nil {
+			return err
+		}
+		lines = wrapText(face, entry.Title, cardWidth-2*cardMargin)
+		if len(lines) <= 3 {
+			break
+		}
+	}
+	if len(lines) > cardMaxLines {
+		lines = lines[:cardMaxLines]
+		lines[cardMaxLines-1] += "…"
+	}
+	lineHeight := face.Metrics().Height.Ceil() * 6 / 5
+	y := 260
+	for _, line := range lines {
+		drawText(img, face, fg, cardMargin, y, line)
+		y += lineHeight
+	}
+
+	// date and author at the bottom
+	var details []string
+	if !entry.Date.IsZero() {
+		details = append(details, dateFormat("January 2, 2006", entry.Date))
+	}
+	if entry.Author != "" {
+		details = append(details, entry.Author)
+	}
+	if len(details) > 0 {
+		face, err = cardFace(cardFonts.regular, 32)
+		if err != nil {
+			return err
+		}
+		drawText(img, face, muted, cardMargin, cardHeight-cardMargin, strings.Join(details, " · "))
+	}
+
+	return png.Encode(w, img)
+}
+
+func cardFace(f *opentype.Font, size float64) (font.Face, error) {
+	return opentype.NewFace(f, &opentype.FaceOptions{Size: size, DPI: 72, Hinting: font.HintingFull})
+}
+
+func drawText(img draw.Image, face font.Face, c color.Color, x, y int, s string) {
+	d := font.Drawer{
+		Dst:  img,
+		Src:  image.NewUniform(c),
+		Face: face,
+		Dot:  fixed.P(x, y),
+	}
+	d.DrawString(s)
+}
+
+// wrapText breaks s into lines no wider than width.
+func wrapText(face font.Face, s string, width int) []string {
+	var lines []string
+	var line string
+	for _, word := range strings.Fields(s) {
+		candidate := word
+		if line != "" {
+			candidate = line + " " + word
+		}
+		if line != "" && font.MeasureString(face, candidate).Ceil() > width {
+			lines = append(lines, line)
+			line = word
+			continue
+		}
+		line = candidate
+	}
+	if line != "" {
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// loadCardLogo decodes the site logo. SVG logos can't be drawn and are
+// left out.
+func loadCardLogo(logo string) image.Image {
+	if logo == "" || strings.HasSuffix(logo, ".svg") {
+		return nil
+	}
+
+	f, err := os.Open(filepath.Join(cfg.ContentDir, filepath.Clean("/"+logo)))
+	if err != nil {
+		log.Println("Error opening logo for social card:", err)
+		return nil
+	}
+	defer f.Close()
+
+	img, _, err := image.Decode(f)
+	if err != nil {
+		log.Println("Error decoding logo for social card:", err)
+		return nil
+	}
+	return img
+}
+
+// parseColor parses a #rgb or #rrggbb theme color, returning def for
+// anything else.
+func parseColor(s string, def color.RGBA) color.RGBA {
+	s = strings.TrimPrefix(strings.TrimSpace(s), "#")
+	if len(s) == 3 {
+		s = string([]byte{s[0], s[0], s[1], s[1], s[2], s[2]})
+	}
+	if len(s) != 6 {
+		return def
+	}
+	v, err := strconv.ParseUint(s, 16, 32)
+	if err != nil {
+		return def
+	}
+	return color.RGBA{uint8(v >> 16), uint8(v >> 8), uint8(v), 0xff}
+}
+
+// buildSocialCard writes an entry's social card next to its page.
+func buildSocialCard(page config.Page, entry content.Entry) {
+	outFile := filepath.Join(cfg.OutputDir, page.Path, cardFileName(entry))
+	wr, err := os.Create(outFile)
+	if err != nil {
+		report.Error("Error creating file:", err)
+		return
+	}
+	defer wr.Close()
+
+	err = renderSocialCard(wr, entry)
+	if err != nil {
+		report.Error("Error rendering social card for", page.Name+"/"+entry.FileName+":", err)
+	}
+}
+
+// serveSocialCard renders the social card of the entry a .png request
+// path belongs to, returning false if there is no such entry.
+func serveSocialCard(w http.ResponseWriter, r *http.Request) bool {
+	lang, rest := splitLanguage(r.URL.Path)
+	rel := strings.TrimSuffix(strings.TrimPrefix(rest, "/"), ".png")
+	parts := strings.SplitN(rel, "/", 2)
+	if len(parts) != 2 {
+		return false
+	}
+
+	var page config.Page
+	for _, p := range cfg.Site.Pages {
+		if p.Collection && p.Name == parts[0] {
+			page = p
+		}
+	}
+	if page.Name == "" {
+		return false
+	}
+	page = localizePage(page, lang)
+
+	file, ok := localizedFile(lang, filepath.Clean("/"+rel)+".md")
+	if !ok {
+		return false
+	}
+	info, err := os.Stat(file)
+	if err != nil {
+		return false
+	}
+
+	// protected entries don't give away their titles
+	entry, ok := createEntry(page, page.Name, parts[1]+".md", nil)
+	if !ok || !entryAccess(page, entry, "").Public() {
+		return false
+	}
+
+	cardCache.Lock()
+	card, cached := cardCache.m[file]
+	cardCache.Unlock()
+
+	if !cached || !card.modTime.Equal(info.ModTime()) {
+
+		var buf bytes.Buffer
+		err = renderSocialCard(&buf, entry)
+		if err != nil {
+			log.Println("Error rendering social card:", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return true
+		}
+
+		card = renderedCard{modTime: info.ModTime(), data: buf.Bytes()}
+		cardCache.Lock()
+		cardCache.m[file] = card
+		cardCache.Unlock()
+	}
+
+	w.Header().Set("Content-Type", "image/png")
+	w.Write(card.data)
+	return true
+}
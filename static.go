@@ -1,9 +1,12 @@
 package main
 
 import (
+	"errors"
+	"io/fs"
 	"log"
 	"net/http"
 	"os"
+	"path/filepath"
 )
 
 func serveStaticFiles() {
@@ -13,16 +16,62 @@ func serveStaticFiles() {
 	if _, err := os.Stat(cfg.ContentDir + "/static"); os.IsNotExist(err) {
 		os.Mkdir(cfg.ContentDir+"/static", 0755)
 	}
-	// serve static files
-	fs := http.FileServer(http.Dir(cfg.ContentDir + "/static"))
+	// serve static files, falling back to those of the installed themes
+	fs := http.FileServer(http.FS(staticFS()))
 	http.Handle("/static/", http.StripPrefix("/static/", fs))
 }
 
+// staticFS returns the content directory's static files layered over those
+// of the installed themes, child themes before their parents.
+func staticFS() fs.FS {
+	layers := layeredFS{os.DirFS(filepath.Join(cfg.ContentDir, "static"))}
+	for i := len(themes) - 1; i >= 0; i-- {
+		if static := themes[i].Static(); static != nil {
+			layers = append(layers, static)
+		}
+	}
+	return layers
+}
+
+// layeredFS opens files from the first file system that has them.
+type layeredFS []fs.FS
+
+func (l layeredFS) Open(name string) (fs.File, error) {
+	err := fs.ErrNotExist
+	for _, fsys := range l {
+		f, e := fsys.Open(name)
+		if e == nil {
+			return f, nil
+		}
+		if !errors.Is(e, fs.ErrNotExist) {
+			return nil, e
+		}
+		err = e
+	}
+	return nil, err
+}
+
 func serveCSSTemplate() {
 	log.Println("Serving CSS from templates")
 	http.HandleFunc("/css/style.css", func(wr http.ResponseWriter, req *http.Request) {
 		wr.Header().Set("Content-Type", "text/css")
-		err := templates.ExecuteTemplate(wr, "styleCSS", cfg.Site)
+		executeTemplate(wr, 0, "styleCSS", cfg.Site)
+	})
+}
+
+// serveScripts serves the site's scripts, kept out of the pages so they
+// work with a strict Content-Security-Policy.
+func serveScripts() {
+	http.HandleFunc("/js/code-copy.js", func(wr http.ResponseWriter, req *http.Request) {
+		wr.Header().Set("Content-Type", "text/javascript")
+		executeTemplate(wr, 0, "codeCopyJS", cfg.Site)
+	})
+}
+
+func serveSyntaxCSS() {
+	http.HandleFunc("/css/syntax.css", func(wr http.ResponseWriter, req *http.Request) {
+		wr.Header().Set("Content-Type", "text/css")
+		err := writeSyntaxCSS(wr)
 		if err != nil {
 			http.Error(wr, err.Error(), http.StatusInternalServerError)
 		}
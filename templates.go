@@ -0,0 +1,355 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+)
+
+// templateErrorPattern matches the location html/template puts in front of
+// parse and execution errors, e.g.
+// template: templates/entry.html.tmpl:12:7: executing "entryHTML" at <.Foo>: ...
+var templateErrorPattern = regexp.MustCompile(`template: ([^:]+):(\d+)(?::(\d+))?: (?:executing "([^"]*)" at <([^>]*)>: )?`)
+
+// templateSource is a template file along with where it came from.
+type templateSource struct {
+	Origin string
+	File   string
+	Data   []byte
+}
+
+var (
+	// templateSources holds every parsed template file, keyed by the name
+	// it was parsed under, which is the name html/template reports errors for.
+	templateSources = make(map[string]templateSource)
+	// templateProviders lists the files defining each template in load order,
+	// the last one is the definition in use.
+	templateProviders = make(map[string][]string)
+	// shortcodeProviders does the same for shortcodes.
+	shortcodeProviders = make(map[string][]string)
+	// templateLoadErrors are the template files that failed to parse.
+	templateLoadErrors []error
+	// pageTemplates are the templates pages and entries may use as their
+	// layout: those ending in HTML defined in a layouts directory.
+	pageTemplates = make(map[string]bool)
+	// unknownLayouts are the layouts already reported as unknown, so each
+	// is reported once rather than for every page using it.
+	unknownLayouts = struct {
+		sync.Mutex
+		m map[string]bool
+	}{m: make(map[string]bool)}
+)
+
+// loadTemplates parses the embedded templates, then those of the installed
+// themes and finally the custom templates in <content_dir>/templates, each
+// overriding the definitions before it. Layouts live in the layouts
+// directory next to the other templates. A file that fails to parse is
+// skipped so the templates it would have replaced stay in use. Deploys
+// load them again.
+func loadTemplates() {
+	templates = template.New("").Funcs(templateFuncs())
+	templateSources = make(map[string]templateSource)
+	templateProviders = make(map[string][]string)
+	shortcodeProviders = make(map[string][]string)
+	templateLoadErrors = nil
+	pageTemplates = make(map[string]bool)
+	unknownLayouts.Lock()
+	unknownLayouts.m = make(map[string]bool)
+	unknownLayouts.Unlock()
+
+	files, err := fs.Glob(templateFiles, "templates/*.tmpl")
+	if err != nil {
+		report.Error("Error listing templates:", err)
+	}
+	layouts, _ := fs.Glob(templateFiles, "templates/layouts/*.tmpl")
+	files = append(files, layouts...)
+	for _, file := range files {
+		data, err := templateFiles.ReadFile(file)
+		if err != nil {
+			report.Error("Error reading template:", err)
+			continue
+		}
+		parseTemplate("embedded", file, data)
+	}
+
+	// Load templates from the installed theme and the themes it extends
+	for _, t := range themes {
+		files := append(t.Glob("templates/*.tmpl"), t.Glob("templates/layouts/*.tmpl")...)
+		if len(files) == 0 {
+			continue
+		}
+		log.Println("Loading templates from theme", t.Name)
+		for _, file := range files {
+			data, err := fs.ReadFile(t.FS, file)
+			if err != nil {
+				report.Error("Error reading template from theme", t.Name+":", err)
+				continue
+			}
+			parseTemplate("theme "+t.Name, filepath.Join("themes", t.Name, file), data)
+		}
+	}
+
+	// Load custom templates from ContentDir/templates to override default templates
+	customTemplatesDir := filepath.Join(cfg.ContentDir, "templates")
+
+	files, err = filepath.Glob(filepath.Join(customTemplatesDir, "*.tmpl"))
+	if err != nil {
+		report.Error("Error reading custom templates directory:", err)
+	}
+	layouts, _ = filepath.Glob(filepath.Join(customTemplatesDir, "layouts", "*.tmpl"))
+	files = append(files, layouts...)
+	if len(files) == 0 {
+		log.Println("No custom templates found")
+	}
+	for _, file := range files {
+		log.Println("Found custom template:", filepath.Base(file))
+		data, err := os.ReadFile(file)
+		if err != nil {
+			report.Error("Error reading custom template:", err)
+			continue
+		}
+		parseTemplate("custom", file, data)
+	}
+
+	loadShortcodes()
+}
+
+// parseTemplate adds a template file to the site's templates and records
+// the templates it defines. The templates ending in HTML of a file in a
+// layouts directory become layouts.
+func parseTemplate(origin, file string, data []byte) {
+	// Parse into a set of its own first to find the names the file
+	// defines without touching the site's templates if it fails.
+	defined, err := template.New(file).Funcs(templateFuncs()).Parse(string(data))
+	if err == nil {
+		_, err = templates.New(file).Parse(string(data))
+	}
+	if err != nil {
+		report.Error("Error loading template", file+":", err)
+		templateLoadErrors = append(templateLoadErrors, err)
+		templateSources[file] = templateSource{Origin: origin, File: file, Data: data}
+		return
+	}
+
+	templateSources[file] = templateSource{Origin: origin, File: file, Data: data}
+	layout := filepath.Base(filepath.Dir(file)) == "layouts"
+	for _, t := range defined.Templates() {
+		if t.Name() == file {
+			continue
+		}
+		templateProviders[t.Name()] = append(templateProviders[t.Name()], file)
+		if layout && strings.HasSuffix(t.Name(), "HTML") {
+			pageTemplates[t.Name()] = true
+		}
+	}
+}
+
+// listTemplates prints every defined template and shortcode with the file
+// providing it, followed by the files it overrides.
+func listTemplates() {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "TEMPLATE\tSOURCE\tFILE\tOVERRIDES")
+	printProviders(w, templateProviders, "")
+	printProviders(w, shortcodeProviders, "shortcode ")
+	w.Flush()
+
+	for _, err := range templateLoadErrors {
+		fmt.Println("ERROR:", err)
+	}
+}
+
+func printProviders(w *tabwriter.Writer, providers map[string][]string, prefix string) {
+	var names []string
+	for name := range providers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		files := providers[name]
+		src := templateSources[files[len(files)-1]]
+		fmt.Fprintf(w, "%s%s\t%s\t%s\t%s\n", prefix, name, src.Origin, src.File, strings.Join(files[:len(files)-1], ", "))
+	}
+}
+
+// executeTemplate renders a template to the response. The output is buffered
+// so a failing template doesn't leave a half written page. With -dev the
+// error is shown in an overlay pointing at the failing template source.
+func executeTemplate(w http.ResponseWriter, status int, name string, data interface{}) {
+	if cfg.Dev && len(templateLoadErrors) > 0 {
+		renderErrorOverlay(w, templateLoadErrors[0], data)
+		return
+	}
+
+	var buf bytes.Buffer
+	err := templates.ExecuteTemplate(&buf, name, data)
+	if err != nil {
+		log.Println("Error executing template:", err)
+		if cfg.Dev {
+			renderErrorOverlay(w, err, data)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if status != 0 {
+		w.WriteHeader(status)
+	}
+	buf.WriteTo(w)
+}
+
+// templateDiagnostic is the data shown by the error overlay.
+type templateDiagnostic struct {
+	Error    string
+	File     string
+	Origin   string
+	Line     int
+	Column   int
+	Template string
+	Action   string
+	Source   []sourceLine
+	Context  string
+}
+
+type sourceLine struct {
+	Number  int
+	Text    string
+	Current bool
+}
+
+// diagnoseTemplateError finds the template file and line an html/template
+// error refers to and the source surrounding it.
+func diagnoseTemplateError(err error, data interface{}) templateDiagnostic {
+	d := templateDiagnostic{Error: err.Error()}
+
+	if m := templateErrorPattern.FindStringSubmatch(err.Error()); m != nil {
+		d.File = m[1]
+		d.Line, _ = strconv.Atoi(m[2])
+		d.Column, _ = strconv.Atoi(m[3])
+		d.Template = m[4]
+		d.Action = m[5]
+	}
+
+	if src, ok := templateSources[d.File]; ok {
+		d.Origin = src.Origin
+		lines := strings.Split(string(src.Data), "\n")
+		for i := d.Line - 5; i <= d.Line+5; i++ {
+			if i < 1 || i > len(lines) {
+				continue
+			}
+			d.Source = append(d.Source, sourceLine{Number: i, Text: lines[i-1], Current: i == d.Line})
+		}
+	}
+
+	if data != nil {
+		d.Context = overlayContext(data)
+	}
+
+	return d
+}
+
+// redactedFields are kept out of the overlay, which shows the data of a
+// page to whoever runs into the error: password hashes of pages and users
+// and the CSRF tokens of the admin.
+var redactedFields = map[string]bool{"password": true, "csrf": true}
+
+// overlayContext returns the data a template was executed with as JSON,
+// with the redacted fields blanked out.
+func overlayContext(data interface{}) string {
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return fmt.Sprintf("(%T can't be shown: %s)", data, err)
+	}
+	var context interface{}
+	err = json.Unmarshal(raw, &context)
+	if err != nil {
+		return fmt.Sprintf("(%T can't be shown: %s)", data, err)
+	}
+	redact(context)
+
+	out, _ := json.MarshalIndent(context, "", "  ")
+	return string(out)
+}
+
+func redact(v interface{}) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for key, value := range v {
+			if s, ok := value.(string); ok && s != "" && redactedFields[strings.ToLower(key)] {
+				v[key] = "[redacted]"
+				continue
+			}
+			redact(value)
+		}
+	case []interface{}:
+		for _, value := range v {
+			redact(value)
+		}
+	}
+}
+
+// renderErrorOverlay writes the development error page for a template error.
+// It doesn't use the site's templates since those may be what is broken.
+func renderErrorOverlay(w http.ResponseWriter, err error, data interface{}) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusInternalServerError)
+
+	err = errorOverlay.Execute(w, diagnoseTemplateError(err, data))
+	if err != nil {
+		log.Println("Error rendering error overlay:", err)
+	}
+}
+
+var errorOverlay = template.Must(template.New("overlay").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Template error</title>
+<style>
+body { margin: 0; padding: 2rem; background: #1e1e1e; color: #ddd; font: 14px/1.5 ui-monospace, Menlo, Consolas, monospace; }
+h1 { color: #ff6b6b; font-size: 1.3rem; margin: 0 0 1rem; }
+h2 { color: #aaa; font-size: 1rem; margin: 2rem 0 .5rem; }
+.error { white-space: pre-wrap; color: #ffb3b3; }
+.meta { color: #aaa; }
+.meta b { color: #ddd; font-weight: normal; }
+pre { background: #2a2a2a; padding: 1rem; overflow: auto; border-radius: 4px; }
+.line { display: block; }
+.line.current { background: #5c1f1f; }
+.num { display: inline-block; width: 3em; color: #777; user-select: none; }
+.context { max-height: 30rem; }
+</style>
+</head>
+<body>
+<h1>Template error</h1>
+<p class="error">{{ .Error }}</p>
+{{- if .File }}
+<p class="meta">
+File <b>{{ .File }}</b>{{ if .Origin }} ({{ .Origin }}){{ end }}, line <b>{{ .Line }}</b>
+{{- if .Template }}, template <b>{{ .Template }}</b>{{ end }}
+{{- if .Action }}, at <b>{{ .Action }}</b>{{ end }}
+</p>
+{{- end }}
+{{- with .Source }}
+<h2>Source</h2>
+<pre>{{ range . }}<span class="line{{ if .Current }} current{{ end }}"><span class="num">{{ .Number }}</span>{{ .Text }}</span>{{ end }}</pre>
+{{- end }}
+{{- with .Context }}
+<h2>Data</h2>
+<pre class="context">{{ . }}</pre>
+{{- end }}
+</body>
+</html>
+`))
@@ -0,0 +1,130 @@
+package theme
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"pubgo/config"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Theme is an installable theme: a file system holding a theme.yaml, a
+// templates directory with *.tmpl files (and templates/shortcodes) and a
+// static directory of assets.
+type Theme struct {
+	Name    string `yaml:"name"`
+	Extends string `yaml:"extends"`
+	FS      fs.FS  `yaml:"-"`
+
+	data []byte
+}
+
+var (
+	registryMu sync.Mutex
+	registry   = make(map[string]fs.FS)
+)
+
+// Register makes a theme compiled into the binary, usually an embed.FS,
+// available under name. Registered themes take precedence over theme
+// directories of the same name.
+func Register(name string, fsys fs.FS) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	registry[name] = fsys
+}
+
+// Load resolves the theme called name and the themes it extends, looking for
+// themes registered with Register and then for directories in dir. The chain
+// is returned with the root parent first and name last. An empty name means
+// no theme.
+func Load(name, dir string) ([]Theme, error) {
+	var chain []Theme
+	seen := make(map[string]bool)
+
+	for name != "" {
+		if seen[name] {
+			return nil, fmt.Errorf("theme %q extends itself", name)
+		}
+		seen[name] = true
+
+		t, err := open(name, dir)
+		if err != nil {
+			return nil, err
+		}
+
+		chain = append([]Theme{t}, chain...)
+		name = t.Extends
+	}
+
+	return chain, nil
+}
+
+// open opens a single theme and reads its theme.yaml.
+func open(name, dir string) (Theme, error) {
+	registryMu.Lock()
+	fsys, ok := registry[name]
+	registryMu.Unlock()
+
+	if !ok {
+		path := filepath.Join(dir, name)
+		if fi, err := os.Stat(path); err != nil || !fi.IsDir() {
+			return Theme{}, fmt.Errorf("theme %q not found in %s", name, dir)
+		}
+		fsys = os.DirFS(path)
+	}
+
+	t := Theme{Name: name}
+	data, err := fs.ReadFile(fsys, "theme.yaml")
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return Theme{}, fmt.Errorf("theme %q: %w", name, err)
+	}
+
+	if err == nil {
+		err = yaml.Unmarshal(data, &t)
+		if err != nil {
+			return Theme{}, fmt.Errorf("theme %q: theme.yaml: %w", name, err)
+		}
+		t.data = data
+	}
+
+	t.Name = name
+	t.FS = fsys
+	return t, nil
+}
+
+// ApplyDefaults sets the colors and options from the theme section of the
+// theme's theme.yaml on dst, leaving settings the theme doesn't mention alone.
+func (t Theme) ApplyDefaults(dst *config.Theme) error {
+	if t.data == nil {
+		return nil
+	}
+
+	defaults := struct {
+		Theme *config.Theme `yaml:"theme"`
+	}{dst}
+
+	return yaml.Unmarshal(t.data, &defaults)
+}
+
+// Glob returns the files in the theme matching pattern.
+func (t Theme) Glob(pattern string) []string {
+	files, _ := fs.Glob(t.FS, pattern)
+	return files
+}
+
+// Static returns the theme's static directory, or nil if it has none.
+func (t Theme) Static() fs.FS {
+	if fi, err := fs.Stat(t.FS, "static"); err != nil || !fi.IsDir() {
+		return nil
+	}
+	sub, err := fs.Sub(t.FS, "static")
+	if err != nil {
+		return nil
+	}
+	return sub
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/term"
+	"gopkg.in/yaml.v2"
+)
+
+// User is someone allowed into the admin. Only a bcrypt hash of their
+// password is kept.
+type User struct {
+	Name     string `yaml:"name"`
+	Email    string `yaml:"email,omitempty"`
+	Role     string `yaml:"role"`
+	Password string `yaml:"password"`
+}
+
+// roles lists what each role may do in the admin. Admins can do
+// everything including deploys, editors look after the site's content and comments, authors
+// can sign in to write.
+var roles = map[string][]string{
+	"admin":  {"edit", "revert", "moderate", "audit", "users", "deploy"},
+	"editor": {"edit", "revert", "moderate"},
+	"author": {"edit"},
+}
+
+// Can reports whether the user's role allows permission.
+func (u User) Can(permission string) bool {
+	for _, p := range roles[u.Role] {
+		if p == permission {
+			return true
+		}
+	}
+	return false
+}
+
+// loadUsers reads the users file. It is read again on every request so
+// users added, removed or given another role take effect right away.
+func loadUsers() ([]User, error) {
+	data, err := os.ReadFile(cfg.Admin.UsersFile)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var users []User
+	err = yaml.Unmarshal(data, &users)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", cfg.Admin.UsersFile, err)
+	}
+	return users, nil
+}
+
+// findUser returns the user called name.
+func findUser(name string) (User, bool) {
+	users, err := loadUsers()
+	if err != nil {
+		return User{}, false
+	}
+	for _, u := range users {
+		if u.Name == name {
+			return u, true
+		}
+	}
+	return User{}, false
+}
+
+// dummyHash is checked against for unknown names, so logging in takes as
+// long whether or not the user exists.
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("pubgo"), bcrypt.DefaultCost)
+
+// authenticate returns the user name and password belong to.
+func authenticate(name, password string) (User, bool) {
+	u, ok := findUser(name)
+	hash := []byte(u.Password)
+	if !ok {
+		hash = dummyHash
+	}
+	err := bcrypt.CompareHashAndPassword(hash, []byte(password))
+	if err != nil || !ok {
+		return User{}, false
+	}
+	return u, true
+}
+
+// checkUsers reports problems with the users file.
+func checkUsers() {
+	users, err := loadUsers()
+	if err != nil {
+		report.Error("Error loading users:", err)
+		return
+	}
+
+	seen := make(map[string]bool)
+	for _, u := range users {
+		switch {
+		case u.Name == "":
+			report.Error("User without a name in", cfg.Admin.UsersFile)
+		case seen[u.Name]:
+			report.Error("User", u.Name, "is listed twice in", cfg.Admin.UsersFile)
+		case roles[u.Role] == nil:
+			report.Error("User", u.Name, "has unknown role", u.Role)
+		}
+		if _, err := bcrypt.Cost([]byte(u.Password)); err != nil {
+			report.Error("User", u.Name, "has no valid bcrypt password hash")
+		}
+		seen[u.Name] = true
+	}
+
+	if cfg.AdminUser != "" || cfg.AdminPass != "" {
+		report.Warn("admin_user and admin_pass are no longer used, add users with: pubgo user <name> <role>")
+	}
+}
+
+// roleNames returns the known roles in order.
+func roleNames() []string {
+	var names []string
+	for name := range roles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// addUser adds a user to the users file or changes the role and password
+// of an existing one. The password is read from standard input.
+//
+//	pubgo user <name> <role>
+func addUser(args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("usage: pubgo user <name> <role>")
+	}
+	name, role := args[0], args[1]
+	if roles[role] == nil {
+		return fmt.Errorf("unknown role %q, use one of %s", role, strings.Join(roleNames(), ", "))
+	}
+
+	hash, err := readPassword("Password for " + name + ": ")
+	if err != nil {
+		return err
+	}
+
+	users, err := loadUsers()
+	if err != nil {
+		return err
+	}
+	user := User{Name: name, Role: role, Password: hash}
+	found := false
+	for i, u := range users {
+		if u.Name == name {
+			users[i], found = user, true
+		}
+	}
+	if !found {
+		users = append(users, user)
+	}
+
+	data, err := yaml.Marshal(users)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(cfg.Admin.UsersFile, data, 0600)
+}
+
+// readPassword asks for a password on standard input and returns its
+// bcrypt hash. Typing isn't echoed on a terminal; piped passwords are read
+// up to the end of the line.
+func readPassword(prompt string) (string, error) {
+	fmt.Fprint(os.Stderr, prompt)
+	var password string
+	if fd := int(os.Stdin.Fd()); term.IsTerminal(fd) {
+		typed, err := term.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return "", fmt.Errorf("reading password: %w", err)
+		}
+		password = string(typed)
+	} else {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			return "", fmt.Errorf("reading password: %w", err)
+		}
+		password = strings.TrimRight(line, "\r\n")
+	}
+	if len(password) < 8 {
+		return "", fmt.Errorf("passwords need at least 8 characters")
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	return string(hash), err
+}
+
+// hashPassword asks for the password of a protected page and returns its
+// hash to put in the page's settings.
+//
+//	pubgo hash
+func hashPassword() (string, error) {
+	return readPassword("Password: ")
+}
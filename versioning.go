@@ -0,0 +1,306 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// unversionedDirs hold comments and form submissions, which come from
+// visitors rather than editors, so they stay out of the history. New
+// content repositories ignore them and commit skips them in the others.
+var unversionedDirs = []string{"comments", "forms"}
+
+// unversioned reports whether file, relative to the content directory,
+// stays out of the history.
+func unversioned(file string) bool {
+	for _, dir := range unversionedDirs {
+		if strings.HasPrefix(filepath.ToSlash(file), dir+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// Revision is a commit changing a content file.
+type Revision struct {
+	Hash    string
+	Author  string
+	Date    time.Time
+	Message string
+}
+
+// Short returns the abbreviated commit hash.
+func (r Revision) Short() string {
+	if len(r.Hash) > 7 {
+		return r.Hash[:7]
+	}
+	return r.Hash
+}
+
+// contentRepository is the git repository holding the content directory.
+type contentRepository struct {
+	sync.Mutex
+	repo *git.Repository
+}
+
+// contentRepo is nil unless git.enabled is set.
+var contentRepo *contentRepository
+
+// openContentRepository opens the repository of the content directory,
+// creating it with the current content as the first commit if needed.
+func openContentRepository() (*contentRepository, error) {
+	repo, err := git.PlainOpen(cfg.ContentDir)
+	if errors.Is(err, git.ErrRepositoryNotExists) {
+		repo, err = git.PlainInit(cfg.ContentDir, false)
+		if err != nil {
+			return nil, err
+		}
+		ignore := filepath.Join(cfg.ContentDir, ".gitignore")
+		if _, err := os.Stat(ignore); os.IsNotExist(err) {
+			var lines strings.Builder
+			for _, dir := range unversionedDirs {
+				lines.WriteString("/" + dir + "/\n")
+			}
+			err = os.WriteFile(ignore, []byte(lines.String()), 0644)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	c := &contentRepository{repo: repo}
+	// deployed content is changed on the remote, commits of its own would
+	// keep the content directory from fast forwarding to it
+	if cfg.Git.WebhookSecret != "" {
+		return c, nil
+	}
+	c.Lock()
+	defer c.Unlock()
+	if _, err := repo.Head(); err == plumbing.ErrReferenceNotFound {
+		return c, c.commit(nil, systemSignature(), "Add content")
+	}
+	return c, c.commitPending()
+}
+
+// setupContentRepository opens the content repository when git.enabled is
+// set.
+func setupContentRepository() {
+	if !cfg.Git.Enabled {
+		return
+	}
+	var err error
+	contentRepo, err = openContentRepository()
+	if err != nil {
+		report.Error("Error opening content repository:", err)
+	}
+}
+
+// systemSignature authors commits of changes made outside the admin.
+func systemSignature() *object.Signature {
+	return &object.Signature{Name: "pubgo", When: time.Now()}
+}
+
+func userSignature(user User) *object.Signature {
+	return &object.Signature{Name: user.Name, Email: user.Email, When: time.Now()}
+}
+
+// commitPending commits changes made to the content directory outside the
+// admin, such as over FTP or on the server, so they aren't attributed to
+// the next user saving an entry.
+func (c *contentRepository) commitPending() error {
+	return c.commit(nil, systemSignature(), "Record changes made outside the admin")
+}
+
+// commit stages the changed files among paths, or every changed file for
+// none, and commits them. Nothing is committed without changes.
+func (c *contentRepository) commit(paths []string, author *object.Signature, message string) error {
+	wt, err := c.repo.Worktree()
+	if err != nil {
+		return err
+	}
+	status, err := wt.Status()
+	if err != nil {
+		return err
+	}
+
+	staged := false
+	for file, s := range status {
+		if unversioned(file) || len(paths) > 0 && !containsString(paths, file) {
+			continue
+		}
+		switch {
+		case s.Worktree == git.Deleted:
+			_, err = wt.Remove(file)
+		case s.Worktree != git.Unmodified:
+			_, err = wt.Add(file)
+		case s.Staging == git.Unmodified:
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		staged = true
+	}
+	if !staged {
+		return nil
+	}
+
+	_, err = wt.Commit(message, &git.CommitOptions{Author: author})
+	return err
+}
+
+// Edit commits the change update makes to the content file rel as user.
+// Changes made outside the admin are committed first.
+func (c *contentRepository) Edit(rel string, user User, message string, update func() error) error {
+	c.Lock()
+	defer c.Unlock()
+	return c.edit(rel, user, message, update)
+}
+
+func (c *contentRepository) edit(rel string, user User, message string, update func() error) error {
+	err := c.commitPending()
+	if err != nil {
+		return err
+	}
+	err = update()
+	if err != nil {
+		return err
+	}
+	return c.commit([]string{rel}, userSignature(user), message)
+}
+
+// History returns the commits changing the content file rel, newest first.
+func (c *contentRepository) History(rel string) ([]Revision, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	if _, err := c.repo.Head(); err == plumbing.ErrReferenceNotFound {
+		return nil, nil
+	}
+	iter, err := c.repo.Log(&git.LogOptions{FileName: &rel})
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Close()
+
+	var history []Revision
+	err = iter.ForEach(func(commit *object.Commit) error {
+		history = append(history, Revision{
+			Hash:    commit.Hash.String(),
+			Author:  commit.Author.Name,
+			Date:    commit.Author.When,
+			Message: strings.TrimSpace(commit.Message),
+		})
+		return nil
+	})
+	return history, err
+}
+
+// Diff returns the changes the commit hash made to rel as a unified diff.
+func (c *contentRepository) Diff(rel, hash string) (string, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	commit, err := c.repo.CommitObject(plumbing.NewHash(hash))
+	if err != nil {
+		return "", err
+	}
+	tree, err := commit.Tree()
+	if err != nil {
+		return "", err
+	}
+
+	var parentTree *object.Tree
+	if commit.NumParents() > 0 {
+		parent, err := commit.Parent(0)
+		if err != nil {
+			return "", err
+		}
+		parentTree, err = parent.Tree()
+		if err != nil {
+			return "", err
+		}
+	}
+
+	changes, err := object.DiffTree(parentTree, tree)
+	if err != nil {
+		return "", err
+	}
+	for _, change := range changes {
+		if change.From.Name != rel && change.To.Name != rel {
+			continue
+		}
+		patch, err := change.Patch()
+		if err != nil {
+			return "", err
+		}
+		return patch.String(), nil
+	}
+	return "", nil
+}
+
+// Revert restores rel to its content as of the commit hash and commits it
+// as user. A file that didn't exist then is removed.
+func (c *contentRepository) Revert(rel, hash string, user User) error {
+	c.Lock()
+	defer c.Unlock()
+
+	commit, err := c.repo.CommitObject(plumbing.NewHash(hash))
+	if err != nil {
+		return err
+	}
+
+	var data []byte
+	exists := true
+	file, err := commit.File(rel)
+	if err == object.ErrFileNotFound {
+		exists = false
+	} else if err != nil {
+		return err
+	} else {
+		contents, err := file.Contents()
+		if err != nil {
+			return err
+		}
+		data = []byte(contents)
+	}
+
+	short := Revision{Hash: hash}.Short()
+	return c.edit(rel, user, fmt.Sprintf("Revert %s to %s", rel, short), func() error {
+		abs := filepath.Join(cfg.ContentDir, filepath.FromSlash(rel))
+		if !exists {
+			return os.Remove(abs)
+		}
+		err := os.MkdirAll(filepath.Dir(abs), 0755)
+		if err != nil {
+			return err
+		}
+		return os.WriteFile(abs, data, 0644)
+	})
+}
+
+// validRevision reports whether rev is a full commit hash.
+func validRevision(rev string) bool {
+	return plumbing.IsHash(rev)
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}